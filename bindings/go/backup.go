@@ -0,0 +1,158 @@
+//go:build cgo
+// +build cgo
+
+package libsql
+
+/*
+#include <libsql.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"unsafe"
+)
+
+// BackupOption configures a Backup.
+type BackupOption interface {
+	apply(*backupConfig)
+}
+
+type backupOption func(*backupConfig)
+
+func (o backupOption) apply(c *backupConfig) { o(c) }
+
+type backupConfig struct {
+	srcName    string
+	dstName    string
+	onProgress func(remaining, total int)
+}
+
+// WithBackupDatabaseNames overrides the ATTACH-style database names
+// SQLite's backup API copies between; both default to "main".
+func WithBackupDatabaseNames(src, dst string) BackupOption {
+	return backupOption(func(c *backupConfig) {
+		c.srcName = src
+		c.dstName = dst
+	})
+}
+
+// WithBackupProgress registers a callback invoked after every Step with the
+// number of pages left to copy and the total page count as of that step.
+func WithBackupProgress(fn func(remaining, total int)) BackupOption {
+	return backupOption(func(c *backupConfig) {
+		c.onProgress = fn
+	})
+}
+
+// BackupHandle drives an online SQLite backup between two already-open
+// *sql.DB handles, started by Backup. Step copies the source database into
+// the destination in bounded chunks while both remain usable -- src for
+// reads and writes, dst for reads only -- until the backup completes.
+// Close must be called once the backup is done or abandoned.
+type BackupHandle struct {
+	nativePtr  C.libsql_backup_t
+	dstConn    *sql.Conn
+	srcConn    *sql.Conn
+	onProgress func(remaining, total int)
+}
+
+// Backup begins an online backup of src into dst, both already-open
+// *sql.DB handles from this package's driver (embedded, file, or
+// :memory:; an embedded replica backs up its local replica file). It
+// acquires one physical connection from each for the lifetime of the
+// returned BackupHandle; call Close to release them. Remote-only
+// connections (opened against libsql://, http://, or https:// with no
+// local file) are rejected, since Hrana has no equivalent of SQLite's
+// backup API.
+func Backup(dst, src *sql.DB, opts ...BackupOption) (*BackupHandle, error) {
+	config := backupConfig{srcName: "main", dstName: "main"}
+	for _, opt := range opts {
+		opt.apply(&config)
+	}
+
+	ctx := context.Background()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		dstConn.Close()
+		return nil, err
+	}
+
+	handle := &BackupHandle{dstConn: dstConn, srcConn: srcConn, onProgress: config.onProgress}
+	err = dstConn.Raw(func(dstDriverConn any) error {
+		dstNative, ok := dstDriverConn.(*conn)
+		if !ok {
+			return fmt.Errorf("libsql: Backup's dst must come from this package's driver")
+		}
+		if dstNative.remote {
+			return fmt.Errorf("libsql: Backup is not supported over Hrana (dst is a remote-only connection)")
+		}
+		return srcConn.Raw(func(srcDriverConn any) error {
+			srcNative, ok := srcDriverConn.(*conn)
+			if !ok {
+				return fmt.Errorf("libsql: Backup's src must come from this package's driver")
+			}
+			if srcNative.remote {
+				return fmt.Errorf("libsql: Backup is not supported over Hrana (src is a remote-only connection)")
+			}
+
+			dstNameCString := C.CString(config.dstName)
+			defer C.free(unsafe.Pointer(dstNameCString))
+			srcNameCString := C.CString(config.srcName)
+			defer C.free(unsafe.Pointer(srcNameCString))
+
+			var errMsg *C.char
+			statusCode := C.libsql_backup_init(dstNative.nativePtr, dstNameCString, srcNative.nativePtr, srcNameCString, &handle.nativePtr, &errMsg)
+			if statusCode != 0 {
+				return libsqlError("failed to start backup", statusCode, errMsg)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		srcConn.Close()
+		dstConn.Close()
+		return nil, err
+	}
+	return handle, nil
+}
+
+// Step copies up to nPages pages from src to dst, or every remaining page
+// if nPages is negative. done reports whether the backup is now complete;
+// remaining and total describe the page counts as of this step, the same
+// values passed to any WithBackupProgress callback.
+func (h *BackupHandle) Step(nPages int) (done bool, remaining, total int, err error) {
+	var errMsg *C.char
+	statusCode := C.libsql_backup_step(h.nativePtr, C.int(nPages), &errMsg)
+	remaining = int(C.libsql_backup_remaining(h.nativePtr))
+	total = int(C.libsql_backup_pagecount(h.nativePtr))
+	if h.onProgress != nil {
+		h.onProgress(remaining, total)
+	}
+	if statusCode != 0 {
+		return false, remaining, total, libsqlError("failed to step backup", statusCode, errMsg)
+	}
+	return remaining == 0, remaining, total, nil
+}
+
+// Close releases the backup and the connections Backup acquired. It is
+// safe to call once Step reports done, or to abandon the backup early.
+func (h *BackupHandle) Close() error {
+	if h.nativePtr != nil {
+		C.libsql_backup_finish(h.nativePtr)
+		h.nativePtr = nil
+	}
+	srcErr := h.srcConn.Close()
+	dstErr := h.dstConn.Close()
+	if srcErr != nil {
+		return srcErr
+	}
+	return dstErr
+}
@@ -0,0 +1,290 @@
+//go:build cgo
+// +build cgo
+
+package libsql
+
+import (
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"fmt"
+	"strings"
+)
+
+// LoaderOption configures a Loader returned by Connector.BeginLoad.
+type LoaderOption interface {
+	apply(*loaderConfig)
+}
+
+type loaderOption func(*loaderConfig)
+
+func (o loaderOption) apply(c *loaderConfig) { o(c) }
+
+type loaderConfig struct {
+	batchSize     int
+	maxBatchBytes int
+	onConflict    string
+}
+
+// WithBatchSize overrides the default number of rows (1000) batched into a
+// single multi-VALUES INSERT, automatically split further if it would
+// exceed SQLite's 32766 bound-parameter cap.
+func WithBatchSize(n int) LoaderOption {
+	return loaderOption(func(c *loaderConfig) {
+		if n > 0 {
+			c.batchSize = n
+		}
+	})
+}
+
+// WithMaxBatchBytes caps a single multi-VALUES INSERT at roughly n bytes of
+// bound values, flushing early even if WithBatchSize's row count has not
+// been reached yet. Useful alongside wide or variable-length rows (e.g.
+// BLOB columns), where a row-count batch size alone can't bound the size of
+// the generated statement.
+func WithMaxBatchBytes(n int) LoaderOption {
+	return loaderOption(func(c *loaderConfig) {
+		if n > 0 {
+			c.maxBatchBytes = n
+		}
+	})
+}
+
+// valueSize estimates the number of bytes v contributes to a batch, for
+// WithMaxBatchBytes accounting. It only needs to be a reasonable estimate,
+// not exact.
+func valueSize(v sqldriver.Value) int {
+	switch v := v.(type) {
+	case []byte:
+		return len(v)
+	case string:
+		return len(v)
+	case nil:
+		return 0
+	default:
+		return 8
+	}
+}
+
+// WithOnConflict rewrites the emitted DML as "INSERT OR <action>", where
+// action is one of "REPLACE", "IGNORE", or "ABORT".
+func WithOnConflict(action string) LoaderOption {
+	return loaderOption(func(c *loaderConfig) {
+		c.onConflict = strings.ToUpper(action)
+	})
+}
+
+// sqliteMaxBoundParams mirrors SQLITE_MAX_VARIABLE_NUMBER's conservative
+// default; Loader never builds a single statement that binds more than this
+// many parameters.
+const sqliteMaxBoundParams = 32766
+
+// RowError reports that a batch failed to load. RowIndex is the 0-based
+// index, counting every row passed to Add, of the first row in that batch;
+// it does not single out which row of the batch caused the failure.
+type RowError struct {
+	RowIndex int
+	Err      error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("libsql: row %d: %v", e.RowIndex, e.Err)
+}
+
+func (e *RowError) Unwrap() error { return e.Err }
+
+// Loader batches rows into large multi-VALUES INSERT statements, modeled on
+// lib/pq's CopyIn, to avoid paying one round-trip (or, for pure-embedded
+// databases, one prepare+bind+step cycle) per row.
+type Loader struct {
+	conn         *conn
+	tx           sqldriver.Tx
+	ownsConn     bool
+	table        string
+	columns      []string
+	cfg          loaderConfig
+	pending      [][]sqldriver.Value
+	pendingBytes int
+	rowsLoaded   int
+	nextIndex    int
+	closed       bool
+}
+
+// BeginLoad returns a Loader that appends rows to table(columns...) on a
+// single connection, batching them into chunked multi-row INSERT statements
+// executed inside one implicit transaction.
+func (c *Connector) BeginLoad(ctx context.Context, table string, columns []string, opts ...LoaderOption) (*Loader, error) {
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("libsql: BeginLoad requires at least one column")
+	}
+	driverConn, err := c.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nativeConn, ok := driverConn.(*conn)
+	if !ok {
+		driverConn.Close()
+		return nil, fmt.Errorf("libsql: BeginLoad requires a libsql connection")
+	}
+	cfg := loaderConfig{batchSize: 1000}
+	for _, opt := range opts {
+		opt.apply(&cfg)
+	}
+	// BeginTx (rather than a raw "BEGIN" ExecContext) is what bumps
+	// nativeConn.txDepth, so the batched INSERTs Add issues below go
+	// through retryingOp's txDepth>0 guard instead of being (unsafely)
+	// auto-retried as if no transaction were open; see retryingOp.
+	tx, err := nativeConn.BeginTx(ctx, sqldriver.TxOptions{})
+	if err != nil {
+		nativeConn.Close()
+		return nil, err
+	}
+	return &Loader{conn: nativeConn, tx: tx, ownsConn: true, table: table, columns: columns, cfg: cfg}, nil
+}
+
+// BulkInsert returns a Loader that batches rows into table(columns...) over
+// an already-acquired *sql.Conn, using the same chunked multi-VALUES INSERT
+// strategy as BeginLoad. It exists alongside BeginLoad for callers that
+// already hold a *sql.Conn from a *sql.DB's pool (e.g. to interleave bulk
+// loading with other work on the same connection) and so don't want a
+// second, separate connection opened just for the load. Unlike BeginLoad,
+// the returned Loader does not own conn: Close commits the load transaction
+// but leaves conn itself for the caller to close.
+//
+// BulkInsert refuses to start against an embedded replica, since driving a
+// large batched INSERT through the replica's local handle gains none of the
+// performance benefit BulkInsert is for: every bound row still has to cross
+// the network to the primary before Sync can pick it up. Open a *sql.Conn
+// against the primary URL directly instead.
+func BulkInsert(ctx context.Context, c *sql.Conn, table string, columns []string, opts ...LoaderOption) (*Loader, error) {
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("libsql: BulkInsert requires at least one column")
+	}
+	var nativeConn *conn
+	if err := c.Raw(func(driverConn any) error {
+		dc, ok := driverConn.(*conn)
+		if !ok {
+			return fmt.Errorf("libsql: BulkInsert requires a libsql connection")
+		}
+		nativeConn = dc
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if nativeConn.primaryUrl != "" {
+		return nil, fmt.Errorf("libsql: BulkInsert does not support embedded replicas; open a connection against the primary (%s) instead", nativeConn.primaryUrl)
+	}
+	cfg := loaderConfig{batchSize: 1000}
+	for _, opt := range opts {
+		opt.apply(&cfg)
+	}
+	tx, err := nativeConn.BeginTx(ctx, sqldriver.TxOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &Loader{conn: nativeConn, tx: tx, table: table, columns: columns, cfg: cfg}, nil
+}
+
+// Add appends one row to the load. vals must be in the same order as the
+// columns passed to BeginLoad. Rows are buffered and only sent once a full
+// batch (or the SQLite bound-parameter cap) is reached; call Flush or Close
+// to force any remainder out.
+func (l *Loader) Add(ctx context.Context, vals ...sqldriver.Value) error {
+	if l.closed {
+		return fmt.Errorf("libsql: Add called on a closed Loader")
+	}
+	if len(vals) != len(l.columns) {
+		return fmt.Errorf("libsql: expected %d values, got %d", len(l.columns), len(vals))
+	}
+	l.pending = append(l.pending, vals)
+	for _, v := range vals {
+		l.pendingBytes += valueSize(v)
+	}
+	maxRowsByParams := sqliteMaxBoundParams / len(l.columns)
+	batchSize := l.cfg.batchSize
+	if maxRowsByParams < batchSize {
+		batchSize = maxRowsByParams
+	}
+	if len(l.pending) >= batchSize {
+		return l.Flush(ctx)
+	}
+	if l.cfg.maxBatchBytes > 0 && l.pendingBytes >= l.cfg.maxBatchBytes {
+		return l.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush sends any buffered rows to the database without ending the load.
+func (l *Loader) Flush(ctx context.Context) error {
+	if len(l.pending) == 0 {
+		return nil
+	}
+	batch := l.pending
+	l.pending = nil
+	l.pendingBytes = 0
+	if err := l.loadBatch(ctx, batch); err != nil {
+		return err
+	}
+	l.rowsLoaded += len(batch)
+	return nil
+}
+
+func (l *Loader) loadBatch(ctx context.Context, batch [][]sqldriver.Value) error {
+	query := l.buildInsert(len(batch))
+	args := make([]sqldriver.NamedValue, 0, len(batch)*len(l.columns))
+	ordinal := 1
+	for _, row := range batch {
+		for _, v := range row {
+			args = append(args, sqldriver.NamedValue{Ordinal: ordinal, Value: v})
+			ordinal++
+		}
+	}
+	firstIndex := l.nextIndex
+	l.nextIndex += len(batch)
+	if _, err := l.conn.ExecContext(ctx, query, args); err != nil {
+		return &RowError{RowIndex: firstIndex, Err: err}
+	}
+	return nil
+}
+
+func (l *Loader) buildInsert(numRows int) string {
+	var b strings.Builder
+	b.WriteString("INSERT ")
+	if l.cfg.onConflict != "" {
+		b.WriteString("OR ")
+		b.WriteString(l.cfg.onConflict)
+		b.WriteString(" ")
+	}
+	b.WriteString("INTO ")
+	b.WriteString(l.table)
+	b.WriteString(" (")
+	b.WriteString(strings.Join(l.columns, ", "))
+	b.WriteString(") VALUES ")
+	rowPlaceholder := "(" + strings.TrimSuffix(strings.Repeat("?,", len(l.columns)), ",") + ")"
+	rows := make([]string, numRows)
+	for i := range rows {
+		rows[i] = rowPlaceholder
+	}
+	b.WriteString(strings.Join(rows, ", "))
+	return b.String()
+}
+
+// Close flushes any remaining rows, commits the load transaction, and
+// returns the total number of rows written.
+func (l *Loader) Close(ctx context.Context) (rowsLoaded int64, err error) {
+	if l.closed {
+		return int64(l.rowsLoaded), nil
+	}
+	l.closed = true
+	if l.ownsConn {
+		defer l.conn.Close()
+	}
+	if err := l.Flush(ctx); err != nil {
+		l.tx.Rollback()
+		return int64(l.rowsLoaded), err
+	}
+	if err := l.tx.Commit(); err != nil {
+		return int64(l.rowsLoaded), err
+	}
+	return int64(l.rowsLoaded), nil
+}
@@ -0,0 +1,76 @@
+//go:build cgo
+// +build cgo
+
+package libsql
+
+/*
+#include <libsql.h>
+#include <stdlib.h>
+
+extern int libsql_go_collation_trampoline(unsigned long long handle, int lenA, char *a, int lenB, char *b);
+*/
+import "C"
+
+import (
+	"fmt"
+	"runtime/cgo"
+	"unsafe"
+)
+
+// Collation is a Go-defined string comparator installed with
+// RegisterCollation, usable in COLLATE clauses, indexes, and ORDER BY. It
+// follows strings.Compare's convention: negative if a sorts before b, zero
+// if they are equal, positive if a sorts after b.
+type Collation func(a, b string) int
+
+type registeredCollation struct {
+	name string
+	cmp  Collation
+}
+
+// RegisterCollation installs a Go-defined collation on every connection
+// opened from this Connector, including memory, file, and embedded-replica
+// connections. Remote-only connectors cannot install native
+// callbacks and return an error noting the collation is not supported over
+// Hrana.
+func (c *Connector) RegisterCollation(name string, cmp Collation) error {
+	if c.isRemoteOnly() {
+		return fmt.Errorf("libsql: registering collation %q is not supported over Hrana (remote-only connections)", name)
+	}
+	c.collationsMu.Lock()
+	defer c.collationsMu.Unlock()
+	c.collations = append(c.collations, registeredCollation{name: name, cmp: cmp})
+	return nil
+}
+
+// installCollations re-installs every collation registered on the connector
+// onto a freshly opened native connection, mirroring installFunctions. The
+// returned handles must be released (see releaseHandles) once the connection
+// they were installed on closes.
+func (c *Connector) installCollations(nativeConnPtr C.libsql_connection_t) ([]cgo.Handle, error) {
+	c.collationsMu.Lock()
+	defer c.collationsMu.Unlock()
+	handles := make([]cgo.Handle, 0, len(c.collations))
+	for _, collation := range c.collations {
+		nameCString := C.CString(collation.name)
+		h := cgo.NewHandle(collation.cmp)
+		var errMsg *C.char
+		statusCode := C.libsql_create_collation_v2(nativeConnPtr, nameCString, C.ulonglong(h), C.libsql_go_collation_trampoline, &errMsg)
+		C.free(unsafe.Pointer(nameCString))
+		if statusCode != 0 {
+			h.Delete()
+			releaseHandles(handles)
+			return nil, libsqlError(fmt.Sprint("failed to register collation ", collation.name), statusCode, errMsg)
+		}
+		handles = append(handles, h)
+	}
+	return handles, nil
+}
+
+//export libsql_go_collation_trampoline
+func libsql_go_collation_trampoline(handle C.ulonglong, lenA C.int, a *C.char, lenB C.int, b *C.char) C.int {
+	cmp := cgo.Handle(handle).Value().(Collation)
+	aStr := C.GoStringN(a, lenA)
+	bStr := C.GoStringN(b, lenB)
+	return C.int(cmp(aStr, bStr))
+}
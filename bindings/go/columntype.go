@@ -0,0 +1,173 @@
+//go:build cgo
+// +build cgo
+
+package libsql
+
+/*
+#include <libsql.h>
+*/
+import "C"
+
+import (
+	"database/sql/driver"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	_ driver.RowsColumnTypeDatabaseTypeName = (*rows)(nil)
+	_ driver.RowsColumnTypeScanType         = (*rows)(nil)
+	_ driver.RowsColumnTypeNullable         = (*rows)(nil)
+	_ driver.RowsColumnTypeLength           = (*rows)(nil)
+	_ driver.RowsColumnTypePrecisionScale   = (*rows)(nil)
+)
+
+// affinity is one of SQLite's five type affinities, derived from a column's
+// decltype by declaredAffinity using the rules from
+// https://www.sqlite.org/datatype3.html#determination_of_column_affinity.
+type affinity int
+
+const (
+	// affinityNone is reported for a column with no decltype at all (for
+	// example an expression result), as opposed to one explicitly declared
+	// BLOB; callers should treat it as "unconstrained", not as blob data.
+	affinityNone affinity = iota
+	affinityInteger
+	affinityText
+	affinityBlob
+	affinityReal
+	affinityNumeric
+)
+
+// declaredAffinity classifies decltype (a column's declared SQL type, as
+// reported by libsql_column_decltype) into a type affinity, following
+// SQLite's own substring-matching rules in the order SQLite applies them.
+func declaredAffinity(decltype string) affinity {
+	decltype = strings.TrimSpace(decltype)
+	if decltype == "" {
+		return affinityNone
+	}
+	upper := strings.ToUpper(decltype)
+	switch {
+	case strings.Contains(upper, "INT"):
+		return affinityInteger
+	case strings.Contains(upper, "CHAR") || strings.Contains(upper, "CLOB") || strings.Contains(upper, "TEXT"):
+		return affinityText
+	case strings.Contains(upper, "BLOB"):
+		return affinityBlob
+	case strings.Contains(upper, "REAL") || strings.Contains(upper, "FLOA") || strings.Contains(upper, "DOUB"):
+		return affinityReal
+	default:
+		return affinityNumeric
+	}
+}
+
+// ColumnTypeDatabaseTypeName returns index's decltype, uppercased, or "" for
+// a column with none (such as an expression result).
+func (r *rows) ColumnTypeDatabaseTypeName(index int) string {
+	return strings.ToUpper(strings.TrimSpace(r.declType(index)))
+}
+
+// ColumnTypeScanType returns the Go type Next populates for index: time.Time
+// for a DATE/DATETIME/TIMESTAMP column (see looksLikeTimeDecltype), the
+// affinity-appropriate Go type for any other declared column, or
+// interface{} for a column with no decltype, since its runtime type can
+// vary row to row.
+func (r *rows) ColumnTypeScanType(index int) reflect.Type {
+	decltype := r.declType(index)
+	if looksLikeTimeDecltype(decltype) {
+		return reflect.TypeOf(time.Time{})
+	}
+	switch declaredAffinity(decltype) {
+	case affinityInteger:
+		return reflect.TypeOf(int64(0))
+	case affinityText:
+		return reflect.TypeOf("")
+	case affinityBlob:
+		return reflect.TypeOf([]byte(nil))
+	case affinityReal, affinityNumeric:
+		return reflect.TypeOf(float64(0))
+	default:
+		return reflect.TypeOf((*any)(nil)).Elem()
+	}
+}
+
+// ColumnTypeNullable reports whether index may hold NULL (false when it is
+// declared NOT NULL), via libsql_column_nullable.
+func (r *rows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	if r.nativePtr == nil || index < 0 || index >= len(r.columnNames) {
+		return false, false
+	}
+	var nullableOut C.int
+	var errMsg *C.char
+	statusCode := C.libsql_column_nullable(r.nativePtr, C.int(index), &nullableOut, &errMsg)
+	if statusCode != 0 {
+		if errMsg != nil {
+			C.libsql_free_string(errMsg)
+		}
+		return false, false
+	}
+	return nullableOut != 0, true
+}
+
+// sizedTypePattern matches a decltype with a parenthesized size, such as
+// "VARCHAR(255)" or "DECIMAL(10,2)", capturing the base type name and one
+// or two integers.
+var sizedTypePattern = regexp.MustCompile(`^([A-Za-z ]+)\(\s*(\d+)\s*(?:,\s*(\d+)\s*)?\)$`)
+
+// ColumnTypeLength reports the declared size of a TEXT or BLOB column: the
+// parenthesized size in its decltype (e.g. 255 for VARCHAR(255)), or
+// math.MaxInt64 for TEXT/BLOB/CLOB with no size given, matching the
+// convention other database/sql drivers use for "unbounded". ok is false for
+// any other affinity, where a length does not apply.
+func (r *rows) ColumnTypeLength(index int) (length int64, ok bool) {
+	decltype := strings.TrimSpace(r.declType(index))
+	if decltype == "" {
+		return 0, false
+	}
+	if m := sizedTypePattern.FindStringSubmatch(decltype); m != nil {
+		switch declaredAffinity(m[1]) {
+		case affinityText, affinityBlob:
+			if n, err := strconv.ParseInt(m[2], 10, 64); err == nil {
+				return n, true
+			}
+		}
+		return 0, false
+	}
+	switch declaredAffinity(decltype) {
+	case affinityText, affinityBlob:
+		return math.MaxInt64, true
+	default:
+		return 0, false
+	}
+}
+
+// ColumnTypePrecisionScale reports the declared precision and scale of a
+// REAL/NUMERIC column with both given in its decltype, e.g. 10 and 2 for
+// DECIMAL(10,2). ok is false for any column whose decltype does not specify
+// both, or whose affinity is not REAL/NUMERIC.
+func (r *rows) ColumnTypePrecisionScale(index int) (precision, scale int64, ok bool) {
+	decltype := strings.TrimSpace(r.declType(index))
+	if decltype == "" {
+		return 0, 0, false
+	}
+	m := sizedTypePattern.FindStringSubmatch(decltype)
+	if m == nil || m[3] == "" {
+		return 0, 0, false
+	}
+	switch declaredAffinity(m[1]) {
+	case affinityReal, affinityNumeric:
+	default:
+		return 0, 0, false
+	}
+	p, err1 := strconv.ParseInt(m[2], 10, 64)
+	s, err2 := strconv.ParseInt(m[3], 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return p, s, true
+}
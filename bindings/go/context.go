@@ -0,0 +1,92 @@
+//go:build cgo
+// +build cgo
+
+package libsql
+
+/*
+#include <libsql.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"context"
+)
+
+// interruptOnDone spawns a goroutine that calls libsql_interrupt on this
+// connection's native handle as soon as ctx is done (cancelled or past its
+// deadline), so a prepare/bind/execute/query call blocked in the native
+// driver returns promptly instead of running until the native driver
+// finishes on its own. The returned stop func must be deferred by the
+// caller right after the blocking call returns; it waits for the watcher
+// goroutine to exit so an interrupt can never land after the caller has
+// moved on to reuse the connection for something else.
+func (c *conn) interruptOnDone(ctx context.Context) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stopped := make(chan struct{})
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		select {
+		case <-ctx.Done():
+			C.libsql_interrupt(c.nativePtr)
+		case <-stopped:
+		}
+	}()
+	return func() {
+		close(stopped)
+		<-watcherDone
+	}
+}
+
+// ctxErr reports ctx's Canceled/DeadlineExceeded in place of err whenever
+// ctx is done, so database/sql sees the standard sentinel errors it expects
+// for retry and pool bookkeeping instead of the native "interrupted" error
+// that interruptOnDone's libsql_interrupt call produces. err is returned
+// unchanged when ctx is not done, or when err is nil.
+func ctxErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if doneErr := ctx.Err(); doneErr != nil {
+		return doneErr
+	}
+	return err
+}
+
+// connectWithContext runs libsqlConnect in the background and returns as
+// soon as either it completes or ctx is done, whichever comes first.
+// libsql_connect has no interrupt hook of its own, so a done ctx does not
+// abort the native call; it only stops the caller from waiting on it. If
+// the connect later succeeds after ctx has already been reported as done,
+// the resulting native connection is closed immediately since nobody holds
+// a reference to it.
+func connectWithContext(ctx context.Context, nativeDbPtr C.libsql_database_t) (C.libsql_connection_t, error) {
+	if ctx.Done() == nil {
+		return libsqlConnect(nativeDbPtr)
+	}
+
+	type result struct {
+		ptr C.libsql_connection_t
+		err error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		ptr, err := libsqlConnect(nativeDbPtr)
+		resultCh <- result{ptr, err}
+	}()
+
+	select {
+	case res := <-resultCh:
+		return res.ptr, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-resultCh; res.err == nil {
+				C.libsql_disconnect(res.ptr)
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
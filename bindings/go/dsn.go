@@ -0,0 +1,198 @@
+//go:build cgo
+// +build cgo
+
+package libsql
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the fully-parsed form of a libsql DSN, as produced by ParseDSN
+// and consumed by FormatDSN and Connector. It mirrors the options
+// NewEmbeddedReplicaConnector accepts, but recovered from a single DSN
+// string rather than functional options, following the precedent set by
+// github.com/go-sql-driver/mysql's Config/ParseDSN and github.com/lib/pq's
+// connection-string parsing. Path, PrimaryURL and ReplicaPath select the
+// connection mode: a non-empty Path opens a local (file or :memory:)
+// database and the remaining fields are ignored; otherwise PrimaryURL alone
+// opens a pure remote (Hrana) connection, and PrimaryURL with ReplicaPath
+// opens an embedded replica synced from PrimaryURL into the local file at
+// ReplicaPath.
+type Config struct {
+	Path         string
+	PrimaryURL   string
+	AuthToken    string
+	ReplicaPath  string
+	SyncInterval time.Duration
+	BusyTimeout  time.Duration
+	SSLMode      string
+	RootCertPath string
+	// RetryPolicy overrides the default retrying of transient errors (see
+	// RetryPolicy and WithRetryPolicy) for the Connector this Config opens.
+	// Nil keeps DefaultRetryPolicy.
+	RetryPolicy *RetryPolicy
+}
+
+// ParseDSN parses a DSN into a Config: "file:" and ":memory:" DSNs (with
+// their own "_"-prefixed query parameters, see parseConnParams) populate
+// Path verbatim for local mode, and "libsql://", "http://", or "https://"
+// URLs populate PrimaryURL and the fields below from the query string.
+// Recognized query parameters for the latter are authToken, replicaPath
+// (presence switches the connection to an embedded replica synced into
+// that local file), syncInterval and busyTimeout (duration strings, e.g.
+// "30s"), tls (one of "disable", "require", "verify-ca", "verify-full", see
+// WithSSLMode), and rootCert (a path to a PEM file of root CAs, see
+// WithRootCAs). Any other query parameter on those schemes is rejected so a
+// typo is caught at parse time rather than silently ignored.
+func ParseDSN(dsn string) (*Config, error) {
+	if strings.HasPrefix(dsn, ":memory:") {
+		return &Config{Path: dsn}, nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "file" {
+		return &Config{Path: dsn}, nil
+	}
+	switch u.Scheme {
+	case "libsql", "http", "https":
+	default:
+		return nil, &UnsupportedSchemeError{Scheme: u.Scheme}
+	}
+	cfg := &Config{}
+	query := u.Query()
+	for key, values := range query {
+		value := values[len(values)-1]
+		switch key {
+		case "authToken":
+			cfg.AuthToken = value
+		case "replicaPath":
+			cfg.ReplicaPath = value
+		case "syncInterval":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("libsql: ParseDSN: invalid syncInterval %q: %w", value, err)
+			}
+			cfg.SyncInterval = d
+		case "busyTimeout":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("libsql: ParseDSN: invalid busyTimeout %q: %w", value, err)
+			}
+			cfg.BusyTimeout = d
+		case "tls":
+			switch value {
+			case "disable", "require", "verify-ca", "verify-full":
+			default:
+				return nil, fmt.Errorf(`libsql: ParseDSN: tls must be one of "disable", "require", "verify-ca" or "verify-full", got %q`, value)
+			}
+			cfg.SSLMode = value
+		case "rootCert":
+			cfg.RootCertPath = value
+		default:
+			return nil, fmt.Errorf("libsql: ParseDSN: unknown query parameter %q", key)
+		}
+	}
+	u.RawQuery = ""
+	cfg.PrimaryURL = u.String()
+	return cfg, nil
+}
+
+// FormatDSN reconstructs a DSN string ParseDSN can parse back into an
+// equivalent Config. It is the inverse of ParseDSN, useful for logging or
+// rewriting a Config programmatically before opening it.
+func FormatDSN(cfg *Config) string {
+	if cfg.Path != "" {
+		return cfg.Path
+	}
+	u, err := url.Parse(cfg.PrimaryURL)
+	if err != nil {
+		u = &url.URL{}
+	}
+	query := url.Values{}
+	if cfg.AuthToken != "" {
+		query.Set("authToken", cfg.AuthToken)
+	}
+	if cfg.ReplicaPath != "" {
+		query.Set("replicaPath", cfg.ReplicaPath)
+	}
+	if cfg.SyncInterval != 0 {
+		query.Set("syncInterval", cfg.SyncInterval.String())
+	}
+	if cfg.BusyTimeout != 0 {
+		query.Set("busyTimeout", cfg.BusyTimeout.String())
+	}
+	if cfg.SSLMode != "" {
+		query.Set("tls", cfg.SSLMode)
+	}
+	if cfg.RootCertPath != "" {
+		query.Set("rootCert", cfg.RootCertPath)
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// Connector opens a Connector for cfg: a local database if Path is set, an
+// embedded replica synced from PrimaryURL into ReplicaPath if one was
+// given, otherwise a pure remote (Hrana) connection to PrimaryURL. It is
+// the single entry point driver.OpenConnector uses for every DSN, so that
+// sql.Open("libsql", dsn) transparently picks the right mode regardless of
+// whether cfg came from ParseDSN or was built by hand; NewEmbeddedReplicaConnector
+// and NewEmbeddedReplicaConnectorWithAutoSync remain the programmatic way
+// to reach the same modes with functional options instead of a DSN.
+func (cfg *Config) Connector() (*Connector, error) {
+	c, err := cfg.connector()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RetryPolicy != nil {
+		c.retryPolicy = cfg.RetryPolicy.resolve()
+	}
+	return c, nil
+}
+
+func (cfg *Config) connector() (*Connector, error) {
+	if cfg.Path != "" {
+		return openLocalConnector(cfg.Path)
+	}
+	if cfg.ReplicaPath == "" {
+		return openRemoteConnector(cfg.PrimaryURL, cfg.AuthToken)
+	}
+	var opts []Option
+	if cfg.AuthToken != "" {
+		opts = append(opts, WithAuthToken(cfg.AuthToken))
+	}
+	if cfg.SyncInterval != 0 {
+		opts = append(opts, WithSyncInterval(cfg.SyncInterval))
+	}
+	if cfg.SSLMode != "" {
+		opts = append(opts, WithSSLMode(cfg.SSLMode))
+	}
+	if cfg.RootCertPath != "" {
+		pem, err := os.ReadFile(cfg.RootCertPath)
+		if err != nil {
+			return nil, fmt.Errorf("libsql: reading rootCert: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("libsql: rootCert %q contains no valid PEM certificates", cfg.RootCertPath)
+		}
+		opts = append(opts, WithRootCAs(pool))
+	}
+	c, err := NewEmbeddedReplicaConnector(cfg.ReplicaPath, cfg.PrimaryURL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.BusyTimeout != 0 {
+		busyTimeoutMs := strconv.FormatInt(cfg.BusyTimeout.Milliseconds(), 10)
+		c.connParams = &connParams{busyTimeout: busyTimeoutMs}
+	}
+	return c, nil
+}
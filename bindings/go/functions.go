@@ -0,0 +1,386 @@
+//go:build cgo
+// +build cgo
+
+package libsql
+
+/*
+#include <libsql.h>
+#include <stdlib.h>
+
+extern int libsql_go_scalar_trampoline(unsigned long long handle, int argc, libsql_value_t *argv, libsql_value_t *out, char **errMsg);
+extern int libsql_go_step_trampoline(unsigned long long handle, unsigned long long aggCtx, int argc, libsql_value_t *argv, char **errMsg);
+extern int libsql_go_final_trampoline(unsigned long long handle, unsigned long long aggCtx, libsql_value_t *out, char **errMsg);
+extern int libsql_go_value_trampoline(unsigned long long handle, unsigned long long aggCtx, libsql_value_t *out, char **errMsg);
+extern int libsql_go_inverse_trampoline(unsigned long long handle, unsigned long long aggCtx, int argc, libsql_value_t *argv, char **errMsg);
+*/
+import "C"
+
+import (
+	sqldriver "database/sql/driver"
+	"fmt"
+	"runtime/cgo"
+	"sync"
+	"unsafe"
+)
+
+// FunctionContext is passed to every user-defined SQL function invocation. It
+// carries the means to report an error back to the query engine.
+type FunctionContext struct {
+	userData any
+	err      error
+}
+
+// UserData returns the context's user data. None of the registration
+// functions take a user-data value, so every FunctionContext the driver
+// creates has none and UserData returns nil.
+func (c *FunctionContext) UserData() any {
+	return c.userData
+}
+
+// SetError records an error to be surfaced to the SQL caller in place of a
+// result. Once set, the function's return value is ignored.
+func (c *FunctionContext) SetError(err error) {
+	c.err = err
+}
+
+// ScalarFunction is a pure Go callback invoked once per row for a
+// `SELECT my_func(...)`-style call.
+type ScalarFunction func(ctx *FunctionContext, args []sqldriver.Value) (sqldriver.Value, error)
+
+// AggregateFunction is implemented by accumulators used across the rows of a
+// `GROUP BY`. A type that additionally implements WindowFunction can also be
+// used inside `OVER (...)`.
+type AggregateFunction interface {
+	// Step is called once per input row.
+	Step(ctx *FunctionContext, args []sqldriver.Value) error
+	// Final is called once all rows have been stepped and returns the
+	// aggregate's result.
+	Final(ctx *FunctionContext) (sqldriver.Value, error)
+}
+
+// WindowFunction extends AggregateFunction so the same accumulator can also
+// serve as a window function.
+type WindowFunction interface {
+	AggregateFunction
+	// WindowInverse removes a row that is leaving the current frame.
+	WindowInverse(ctx *FunctionContext, args []sqldriver.Value) error
+	// WindowValue returns the current value of the window without
+	// finalizing the aggregate.
+	WindowValue(ctx *FunctionContext) (sqldriver.Value, error)
+}
+
+// AggregateFactory creates a new, zero-valued accumulator for a single
+// `GROUP BY` group or window partition.
+type AggregateFactory func() AggregateFunction
+
+type registeredFunction struct {
+	name          string
+	argc          int
+	deterministic bool
+	scalar        ScalarFunction
+	aggregate     AggregateFactory
+}
+
+// RegisterScalarFunction installs a Go-defined scalar SQL function on every
+// connection opened from this Connector, including memory, file, and
+// embedded-replica connections. Remote-only connectors cannot
+// install native callbacks and return an error noting the function is not
+// supported over Hrana.
+func (c *Connector) RegisterScalarFunction(name string, argc int, fn ScalarFunction) error {
+	return c.registerFunction(registeredFunction{name: name, argc: argc, scalar: fn})
+}
+
+// MustRegisterDeterministicScalarFunction is like RegisterScalarFunction but
+// marks the function SQLITE_DETERMINISTIC, letting the query planner hoist
+// or cache calls, and panics instead of returning an error.
+func (c *Connector) MustRegisterDeterministicScalarFunction(name string, argc int, fn ScalarFunction) {
+	if err := c.registerFunction(registeredFunction{name: name, argc: argc, scalar: fn, deterministic: true}); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterAggregateFunction installs a Go-defined aggregate SQL function,
+// usable with `GROUP BY`, on every connection opened from this Connector. If
+// the accumulators returned by aggFactory also implement WindowFunction, the
+// function can additionally be used with `OVER (...)`.
+func (c *Connector) RegisterAggregateFunction(name string, argc int, aggFactory AggregateFactory) error {
+	return c.registerFunction(registeredFunction{name: name, argc: argc, aggregate: aggFactory})
+}
+
+// RegisterScalarFunction is a package-level convenience wrapper around
+// Connector.RegisterScalarFunction.
+func RegisterScalarFunction(connector *Connector, name string, argc int, fn ScalarFunction) error {
+	return connector.RegisterScalarFunction(name, argc, fn)
+}
+
+// RegisterAggregateFunction is a package-level convenience wrapper around
+// Connector.RegisterAggregateFunction.
+func RegisterAggregateFunction(connector *Connector, name string, argc int, aggFactory AggregateFactory) error {
+	return connector.RegisterAggregateFunction(name, argc, aggFactory)
+}
+
+func (c *Connector) registerFunction(fn registeredFunction) error {
+	if c.isRemoteOnly() {
+		return fmt.Errorf("libsql: registering function %q is not supported over Hrana (remote-only connections)", fn.name)
+	}
+	c.funcsMu.Lock()
+	defer c.funcsMu.Unlock()
+	c.funcs = append(c.funcs, fn)
+	return nil
+}
+
+// installFunctions re-installs every function registered on the connector
+// onto a freshly opened native connection, so that memory, file,
+// embedded-replica, and remote connections all share the same function set.
+// The returned handles must be released (see releaseHandles) once the
+// connection they were installed on closes.
+func (c *Connector) installFunctions(nativeConnPtr C.libsql_connection_t) ([]cgo.Handle, error) {
+	c.funcsMu.Lock()
+	defer c.funcsMu.Unlock()
+	handles := make([]cgo.Handle, 0, len(c.funcs))
+	for _, fn := range c.funcs {
+		h, err := installFunction(nativeConnPtr, fn)
+		if err != nil {
+			releaseHandles(handles)
+			return nil, err
+		}
+		handles = append(handles, h)
+	}
+	return handles, nil
+}
+
+func installFunction(nativeConnPtr C.libsql_connection_t, fn registeredFunction) (cgo.Handle, error) {
+	nameCString := C.CString(fn.name)
+	defer C.free(unsafe.Pointer(nameCString))
+
+	deterministic := C.int(0)
+	if fn.deterministic {
+		deterministic = C.int(1)
+	}
+
+	var errMsg *C.char
+	var statusCode C.int
+	var h cgo.Handle
+	switch {
+	case fn.scalar != nil:
+		h = cgo.NewHandle(fn.scalar)
+		statusCode = C.libsql_create_function_v2(nativeConnPtr, nameCString, C.int(fn.argc), deterministic, C.ulonglong(h),
+			C.libsql_go_scalar_trampoline, nil, nil, nil, &errMsg)
+	case fn.aggregate != nil:
+		h = cgo.NewHandle(fn.aggregate)
+		statusCode = C.libsql_create_window_function_v2(nativeConnPtr, nameCString, C.int(fn.argc), deterministic, C.ulonglong(h),
+			C.libsql_go_step_trampoline, C.libsql_go_final_trampoline, C.libsql_go_value_trampoline, C.libsql_go_inverse_trampoline, &errMsg)
+	default:
+		return 0, fmt.Errorf("libsql: registered function %q has neither a scalar nor an aggregate implementation", fn.name)
+	}
+	if statusCode != 0 {
+		h.Delete()
+		return 0, libsqlError(fmt.Sprint("failed to register function ", fn.name), statusCode, errMsg)
+	}
+	return h, nil
+}
+
+// releaseHandles deletes every cgo.Handle in handles, letting Go's GC collect
+// the closures they pointed to. Called once per conn, when it closes -- until
+// then, SQLite only ever hands the raw handle value back to the trampolines,
+// so Go's GC must not collect what they point to; see conn.Close.
+func releaseHandles(handles []cgo.Handle) {
+	for _, h := range handles {
+		h.Delete()
+	}
+}
+
+// goValueFromNative converts a libsql_value_t handed to us by the C
+// trampolines into the sqldriver.Value kinds conn.execute already knows how to
+// bind back (int64, float64, string, []byte, nil).
+func goValueFromNative(v C.libsql_value_t) (sqldriver.Value, error) {
+	switch int(C.libsql_value_type(v)) {
+	case TYPE_NULL:
+		return nil, nil
+	case TYPE_INT:
+		return int64(C.libsql_value_int(v)), nil
+	case TYPE_FLOAT:
+		return float64(C.libsql_value_double(v)), nil
+	case TYPE_TEXT:
+		ptr := C.libsql_value_text(v)
+		return C.GoString(ptr), nil
+	case TYPE_BLOB:
+		var length C.int
+		ptr := C.libsql_value_blob(v, &length)
+		return C.GoBytes(unsafe.Pointer(ptr), length), nil
+	default:
+		return nil, fmt.Errorf("libsql: unsupported argument type in user-defined function call")
+	}
+}
+
+// goValueToNative writes a Go function's result into the output slot shared
+// with SQLite, returning the C status code for the trampoline.
+func goValueToNative(result sqldriver.Value, out *C.libsql_value_t, errMsg **C.char) C.int {
+	switch v := result.(type) {
+	case nil:
+		C.libsql_result_null(out)
+	case int64:
+		C.libsql_result_int(out, C.longlong(v))
+	case float64:
+		C.libsql_result_double(out, C.double(v))
+	case string:
+		cstr := C.CString(v)
+		C.libsql_result_text(out, cstr, C.int(len(v)))
+	case []byte:
+		if len(v) == 0 {
+			C.libsql_result_blob(out, nil, 0)
+			break
+		}
+		C.libsql_result_blob(out, unsafe.Pointer(&v[0]), C.int(len(v)))
+	case bool:
+		i := 0
+		if v {
+			i = 1
+		}
+		C.libsql_result_int(out, C.longlong(i))
+	default:
+		return setNativeError(errMsg, fmt.Errorf("libsql: unsupported return type %T from user-defined function", v))
+	}
+	return 0
+}
+
+func goArgsFromNative(argc C.int, argv *C.libsql_value_t) ([]sqldriver.Value, error) {
+	n := int(argc)
+	args := make([]sqldriver.Value, n)
+	slice := unsafe.Slice(argv, n)
+	for i := 0; i < n; i++ {
+		v, err := goValueFromNative(slice[i])
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	return args, nil
+}
+
+func setNativeError(errMsg **C.char, err error) C.int {
+	msg := C.CString(err.Error())
+	*errMsg = msg
+	return 1
+}
+
+//export libsql_go_scalar_trampoline
+func libsql_go_scalar_trampoline(handle C.ulonglong, argc C.int, argv *C.libsql_value_t, out *C.libsql_value_t, errMsg **C.char) C.int {
+	fn := cgo.Handle(handle).Value().(ScalarFunction)
+	args, err := goArgsFromNative(argc, argv)
+	if err != nil {
+		return setNativeError(errMsg, err)
+	}
+	ctx := &FunctionContext{}
+	result, err := fn(ctx, args)
+	if err == nil {
+		err = ctx.err
+	}
+	if err != nil {
+		return setNativeError(errMsg, err)
+	}
+	return goValueToNative(result, out, errMsg)
+}
+
+//export libsql_go_step_trampoline
+func libsql_go_step_trampoline(handle C.ulonglong, aggCtx C.ulonglong, argc C.int, argv *C.libsql_value_t, errMsg **C.char) C.int {
+	factory := cgo.Handle(handle).Value().(AggregateFactory)
+	acc := aggregateState(aggCtx, factory)
+	args, err := goArgsFromNative(argc, argv)
+	if err != nil {
+		return setNativeError(errMsg, err)
+	}
+	ctx := &FunctionContext{}
+	if err := acc.Step(ctx, args); err != nil {
+		return setNativeError(errMsg, err)
+	}
+	if ctx.err != nil {
+		return setNativeError(errMsg, ctx.err)
+	}
+	return 0
+}
+
+//export libsql_go_final_trampoline
+func libsql_go_final_trampoline(handle C.ulonglong, aggCtx C.ulonglong, out *C.libsql_value_t, errMsg **C.char) C.int {
+	factory := cgo.Handle(handle).Value().(AggregateFactory)
+	acc := aggregateState(aggCtx, factory)
+	defer aggregateDone(aggCtx)
+	ctx := &FunctionContext{}
+	result, err := acc.Final(ctx)
+	if err == nil {
+		err = ctx.err
+	}
+	if err != nil {
+		return setNativeError(errMsg, err)
+	}
+	return goValueToNative(result, out, errMsg)
+}
+
+//export libsql_go_value_trampoline
+func libsql_go_value_trampoline(handle C.ulonglong, aggCtx C.ulonglong, out *C.libsql_value_t, errMsg **C.char) C.int {
+	factory := cgo.Handle(handle).Value().(AggregateFactory)
+	acc := aggregateState(aggCtx, factory)
+	win, ok := acc.(WindowFunction)
+	if !ok {
+		return setNativeError(errMsg, fmt.Errorf("libsql: aggregate does not support window value extraction"))
+	}
+	ctx := &FunctionContext{}
+	result, err := win.WindowValue(ctx)
+	if err == nil {
+		err = ctx.err
+	}
+	if err != nil {
+		return setNativeError(errMsg, err)
+	}
+	return goValueToNative(result, out, errMsg)
+}
+
+//export libsql_go_inverse_trampoline
+func libsql_go_inverse_trampoline(handle C.ulonglong, aggCtx C.ulonglong, argc C.int, argv *C.libsql_value_t, errMsg **C.char) C.int {
+	factory := cgo.Handle(handle).Value().(AggregateFactory)
+	acc := aggregateState(aggCtx, factory)
+	win, ok := acc.(WindowFunction)
+	if !ok {
+		return setNativeError(errMsg, fmt.Errorf("libsql: aggregate does not support OVER(...) windows"))
+	}
+	args, err := goArgsFromNative(argc, argv)
+	if err != nil {
+		return setNativeError(errMsg, err)
+	}
+	ctx := &FunctionContext{}
+	err = win.WindowInverse(ctx, args)
+	if err == nil {
+		err = ctx.err
+	}
+	if err != nil {
+		return setNativeError(errMsg, err)
+	}
+	return 0
+}
+
+// aggregateAccumulators maps the lifetime of a single GROUP BY group or
+// window partition (identified by the aggregate context libsql hands back
+// alongside the registration handle) to its Go accumulator.
+var aggregateAccumulators = struct {
+	mu    sync.Mutex
+	state map[C.ulonglong]AggregateFunction
+}{state: make(map[C.ulonglong]AggregateFunction)}
+
+func aggregateState(aggCtx C.ulonglong, factory AggregateFactory) AggregateFunction {
+	aggregateAccumulators.mu.Lock()
+	defer aggregateAccumulators.mu.Unlock()
+	acc, ok := aggregateAccumulators.state[aggCtx]
+	if !ok {
+		acc = factory()
+		aggregateAccumulators.state[aggCtx] = acc
+	}
+	return acc
+}
+
+// aggregateDone releases the accumulator associated with a finished group or
+// window partition once SQLite calls Final.
+func aggregateDone(aggCtx C.ulonglong) {
+	aggregateAccumulators.mu.Lock()
+	defer aggregateAccumulators.mu.Unlock()
+	delete(aggregateAccumulators.state, aggCtx)
+}
@@ -0,0 +1,202 @@
+//go:build cgo
+// +build cgo
+
+package libsql
+
+/*
+#include <libsql.h>
+#include <stdlib.h>
+
+extern void libsql_go_update_hook_trampoline(unsigned long long handle, int op, char *db, char *table, long long rowid);
+extern void libsql_go_preupdate_hook_trampoline(unsigned long long handle, int op, char *db, char *table, long long rowid);
+extern int libsql_go_commit_hook_trampoline(unsigned long long handle);
+extern void libsql_go_rollback_hook_trampoline(unsigned long long handle);
+extern int libsql_go_authorizer_trampoline(unsigned long long handle, int action, char *arg1, char *arg2, char *dbName, char *triggerOrView);
+*/
+import "C"
+
+import (
+	"fmt"
+	"runtime/cgo"
+)
+
+// UpdateOp identifies the kind of row-level change reported to an
+// UpdateHook or PreUpdateHook, using the same values SQLite passes to
+// sqlite3_update_hook.
+type UpdateOp int
+
+const (
+	OpInsert UpdateOp = 18 // SQLITE_INSERT
+	OpDelete UpdateOp = 9  // SQLITE_DELETE
+	OpUpdate UpdateOp = 23 // SQLITE_UPDATE
+)
+
+// UpdateHook is invoked once a row has been inserted, updated, or deleted.
+type UpdateHook func(op UpdateOp, db, table string, rowID int64)
+
+// CommitHook is invoked immediately before a transaction commits. Returning
+// non-zero vetoes the commit, turning it into a rollback; a RollbackHook (if
+// registered) then fires as it would for any other rollback.
+type CommitHook func() int
+
+// RollbackHook is invoked whenever a transaction rolls back, whether
+// explicitly or because a CommitHook vetoed the commit.
+type RollbackHook func()
+
+// AuthAction identifies the kind of operation presented to an Authorizer,
+// using the same action codes sqlite3_set_authorizer passes to its
+// callback (SQLITE_CREATE_TABLE, SQLITE_INSERT, SQLITE_READ, ...).
+type AuthAction int
+
+// AuthResult is returned by an Authorizer to allow, deny, or silently
+// ignore the action under consideration, using the same result codes
+// sqlite3_set_authorizer expects back.
+type AuthResult int
+
+const (
+	AuthOk     AuthResult = 0 // SQLITE_OK: allow the action.
+	AuthDeny   AuthResult = 1 // SQLITE_DENY: abort the statement with an error.
+	AuthIgnore AuthResult = 2 // SQLITE_IGNORE: silently disallow, e.g. substituting NULL for a denied column read.
+)
+
+// Authorizer is consulted once per operation (table access, column read,
+// pragma, function call, ...) while SQLite compiles a statement, deciding
+// whether it proceeds (AuthOk), is denied outright (AuthDeny), or is
+// silently disallowed (AuthIgnore). arg1 and arg2 carry action-specific
+// detail (e.g. table and column name for an SQLITE_READ action); either may
+// be empty. dbName is the schema ("main", "temp", ...) and triggerOrView
+// names the trigger or view responsible for the access, or is empty for a
+// direct statement.
+type Authorizer func(action AuthAction, arg1, arg2, dbName, triggerOrView string) AuthResult
+
+// RegisterUpdateHook installs a Go-defined update hook, fired after a row
+// is inserted, updated, or deleted, on every connection opened from this
+// Connector, replacing any update hook registered earlier. Remote-only
+// connectors return an error since Hrana has no equivalent. SQLite keeps at
+// most one update hook per connection; installing a PreUpdateHook does not
+// affect this one.
+func (c *Connector) RegisterUpdateHook(hook UpdateHook) error {
+	if c.isRemoteOnly() {
+		return fmt.Errorf("libsql: registering an update hook is not supported over Hrana (remote-only connections)")
+	}
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.updateHook = hook
+	return nil
+}
+
+// RegisterPreUpdateHook is like RegisterUpdateHook, except the hook fires
+// before the row is changed rather than after.
+func (c *Connector) RegisterPreUpdateHook(hook UpdateHook) error {
+	if c.isRemoteOnly() {
+		return fmt.Errorf("libsql: registering a pre-update hook is not supported over Hrana (remote-only connections)")
+	}
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.preUpdateHook = hook
+	return nil
+}
+
+// RegisterCommitHook installs a Go-defined commit hook on every connection
+// opened from this Connector, replacing any commit hook registered earlier.
+func (c *Connector) RegisterCommitHook(hook CommitHook) error {
+	if c.isRemoteOnly() {
+		return fmt.Errorf("libsql: registering a commit hook is not supported over Hrana (remote-only connections)")
+	}
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.commitHook = hook
+	return nil
+}
+
+// RegisterRollbackHook installs a Go-defined rollback hook on every
+// connection opened from this Connector, replacing any rollback hook
+// registered earlier.
+func (c *Connector) RegisterRollbackHook(hook RollbackHook) error {
+	if c.isRemoteOnly() {
+		return fmt.Errorf("libsql: registering a rollback hook is not supported over Hrana (remote-only connections)")
+	}
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.rollbackHook = hook
+	return nil
+}
+
+// RegisterAuthorizer installs a Go-defined authorizer on every connection
+// opened from this Connector, replacing any authorizer registered earlier.
+func (c *Connector) RegisterAuthorizer(authorizer Authorizer) error {
+	if c.isRemoteOnly() {
+		return fmt.Errorf("libsql: registering an authorizer is not supported over Hrana (remote-only connections)")
+	}
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.authorizer = authorizer
+	return nil
+}
+
+// installHooks re-installs whichever hooks are registered on the connector
+// onto a freshly opened native connection, mirroring installFunctions. The
+// returned handles must be released (see releaseHandles) once the connection
+// they were installed on closes.
+func (c *Connector) installHooks(nativeConnPtr C.libsql_connection_t) []cgo.Handle {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	var handles []cgo.Handle
+	if c.updateHook != nil {
+		h := cgo.NewHandle(c.updateHook)
+		handles = append(handles, h)
+		C.libsql_update_hook(nativeConnPtr, C.ulonglong(h), C.libsql_go_update_hook_trampoline)
+	}
+	if c.preUpdateHook != nil {
+		h := cgo.NewHandle(c.preUpdateHook)
+		handles = append(handles, h)
+		C.libsql_preupdate_hook(nativeConnPtr, C.ulonglong(h), C.libsql_go_preupdate_hook_trampoline)
+	}
+	if c.commitHook != nil {
+		h := cgo.NewHandle(c.commitHook)
+		handles = append(handles, h)
+		C.libsql_commit_hook(nativeConnPtr, C.ulonglong(h), C.libsql_go_commit_hook_trampoline)
+	}
+	if c.rollbackHook != nil {
+		h := cgo.NewHandle(c.rollbackHook)
+		handles = append(handles, h)
+		C.libsql_rollback_hook(nativeConnPtr, C.ulonglong(h), C.libsql_go_rollback_hook_trampoline)
+	}
+	if c.authorizer != nil {
+		h := cgo.NewHandle(c.authorizer)
+		handles = append(handles, h)
+		C.libsql_set_authorizer(nativeConnPtr, C.ulonglong(h), C.libsql_go_authorizer_trampoline)
+	}
+	return handles
+}
+
+//export libsql_go_update_hook_trampoline
+func libsql_go_update_hook_trampoline(handle C.ulonglong, op C.int, db, table *C.char, rowID C.longlong) {
+	hook := cgo.Handle(handle).Value().(UpdateHook)
+	hook(UpdateOp(op), C.GoString(db), C.GoString(table), int64(rowID))
+}
+
+//export libsql_go_preupdate_hook_trampoline
+func libsql_go_preupdate_hook_trampoline(handle C.ulonglong, op C.int, db, table *C.char, rowID C.longlong) {
+	hook := cgo.Handle(handle).Value().(UpdateHook)
+	hook(UpdateOp(op), C.GoString(db), C.GoString(table), int64(rowID))
+}
+
+//export libsql_go_commit_hook_trampoline
+func libsql_go_commit_hook_trampoline(handle C.ulonglong) C.int {
+	hook := cgo.Handle(handle).Value().(CommitHook)
+	return C.int(hook())
+}
+
+//export libsql_go_rollback_hook_trampoline
+func libsql_go_rollback_hook_trampoline(handle C.ulonglong) {
+	hook := cgo.Handle(handle).Value().(RollbackHook)
+	hook()
+}
+
+//export libsql_go_authorizer_trampoline
+func libsql_go_authorizer_trampoline(handle C.ulonglong, action C.int, arg1, arg2, dbName, triggerOrView *C.char) C.int {
+	authorizer := cgo.Handle(handle).Value().(Authorizer)
+	result := authorizer(AuthAction(action), C.GoString(arg1), C.GoString(arg2), C.GoString(dbName), C.GoString(triggerOrView))
+	return C.int(result)
+}
@@ -0,0 +1,628 @@
+package libsql
+
+// This file implements a pure-Go database/sql driver over HTTP, registered
+// under the "libsql+http" name (sql.Open("libsql+http", dsn)). Unlike the
+// rest of this package, it has no "cgo" build constraint and imports no "C"
+// package, so it builds and runs without the native libsql library --
+// useful in environments where the C library can't be linked. It promotes
+// what used to be a one-shot helper (posting a single SQL statement and
+// parsing back a single result set) into a proper driver.Connector/Conn/
+// Stmt/Tx, adding transactional batching, retry, and compression along the
+// way.
+//
+// Wire format: a POST to the connector's URL carries a JSON body
+// {"statements": [{"q": "...", "params": ..., "condition": {"type": "ok",
+// "step": N}}, ...]}, executed in order; a statement other than the first
+// may carry a "condition" naming an earlier 0-indexed step that must have
+// succeeded ("ok") for this one to run, which is how BeginTx/Commit give a
+// multi-statement transaction single-round-trip, server-side rollback-on-
+// failure semantics without needing a stateful session between requests.
+// The response is a JSON array with one entry per statement, each either
+// {"results": {"columns": [...], "rows": [[...], ...]}} or {"error":
+// {"message": "..."}}.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+func init() {
+	sql.Register("libsql+http", httpDriverImpl{})
+}
+
+// httpConfig holds HTTPConnector's options; see HTTPOption.
+type httpConfig struct {
+	authToken           *string
+	maxIdleConnsPerHost *int
+	maxRetries          *int
+}
+
+// HTTPOption configures NewHTTPConnector, mirroring how Option configures
+// the native Connector.
+type HTTPOption interface {
+	apply(*httpConfig) error
+}
+
+type httpOption func(*httpConfig) error
+
+func (o httpOption) apply(c *httpConfig) error {
+	return o(c)
+}
+
+// WithHTTPAuthToken sends token as an "Authorization: Bearer <token>" header
+// on every request this connector makes.
+func WithHTTPAuthToken(token string) HTTPOption {
+	return httpOption(func(c *httpConfig) error {
+		if c.authToken != nil {
+			return fmt.Errorf("authToken already set")
+		}
+		if token == "" {
+			return fmt.Errorf("authToken must not be empty")
+		}
+		c.authToken = &token
+		return nil
+	})
+}
+
+// WithHTTPMaxIdleConnsPerHost overrides the connector's *http.Client's
+// MaxIdleConnsPerHost (default 8), letting a caller issuing many concurrent
+// requests against one host keep more connections warm.
+func WithHTTPMaxIdleConnsPerHost(n int) HTTPOption {
+	return httpOption(func(c *httpConfig) error {
+		if c.maxIdleConnsPerHost != nil {
+			return fmt.Errorf("maxIdleConnsPerHost already set")
+		}
+		if n <= 0 {
+			return fmt.Errorf("maxIdleConnsPerHost must be positive")
+		}
+		c.maxIdleConnsPerHost = &n
+		return nil
+	})
+}
+
+// WithHTTPMaxRetries overrides how many times a request is retried after a
+// 5xx response (default 3), with exponential, jittered backoff between
+// attempts.
+func WithHTTPMaxRetries(n int) HTTPOption {
+	return httpOption(func(c *httpConfig) error {
+		if c.maxRetries != nil {
+			return fmt.Errorf("maxRetries already set")
+		}
+		if n < 0 {
+			return fmt.Errorf("maxRetries must not be negative")
+		}
+		c.maxRetries = &n
+		return nil
+	})
+}
+
+// HTTPConnector is a driver.Connector that executes statements over HTTP
+// against a Hrana-style batch endpoint, with no dependency on the native
+// libsql library. Use NewHTTPConnector to build one directly, or
+// sql.Open("libsql+http", dsn) to build one from a DSN.
+type HTTPConnector struct {
+	url        string
+	authToken  string
+	maxRetries int
+	client     *http.Client
+}
+
+// NewHTTPConnector builds an HTTPConnector that posts batches to url (e.g.
+// "https://my-db.turso.io").
+func NewHTTPConnector(rawURL string, opts ...HTTPOption) (*HTTPConnector, error) {
+	var cfg httpConfig
+	for _, opt := range opts {
+		if err := opt.apply(&cfg); err != nil {
+			return nil, fmt.Errorf("libsql+http: %w", err)
+		}
+	}
+	maxIdleConnsPerHost := 8
+	if cfg.maxIdleConnsPerHost != nil {
+		maxIdleConnsPerHost = *cfg.maxIdleConnsPerHost
+	}
+	maxRetries := 3
+	if cfg.maxRetries != nil {
+		maxRetries = *cfg.maxRetries
+	}
+	c := &HTTPConnector{
+		url:        rawURL,
+		maxRetries: maxRetries,
+		client: &http.Client{
+			Transport: &http.Transport{MaxIdleConnsPerHost: maxIdleConnsPerHost},
+		},
+	}
+	if cfg.authToken != nil {
+		c.authToken = *cfg.authToken
+	}
+	return c, nil
+}
+
+// Connect implements driver.Connector. An HTTP connection holds no socket
+// of its own between requests, so this never fails for reasons other than a
+// canceled/expired ctx.
+func (c *HTTPConnector) Connect(ctx context.Context) (sqldriver.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &httpConn{connector: c}, nil
+}
+
+func (c *HTTPConnector) Driver() sqldriver.Driver {
+	return httpDriverImpl{}
+}
+
+// httpDriverImpl is the database/sql-registered driver for the
+// "libsql+http" name.
+type httpDriverImpl struct{}
+
+func (httpDriverImpl) Open(dsn string) (sqldriver.Conn, error) {
+	connector, err := httpDriverImpl{}.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(context.Background())
+}
+
+// OpenConnector parses dsn as a URL; an "authToken" query parameter, if
+// present, is removed from the URL used for requests and sent instead as a
+// Bearer token header (see WithHTTPAuthToken).
+func (httpDriverImpl) OpenConnector(dsn string) (sqldriver.Connector, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("libsql+http: invalid DSN %q: %w", dsn, err)
+	}
+	var opts []HTTPOption
+	q := u.Query()
+	if token := q.Get("authToken"); token != "" {
+		opts = append(opts, WithHTTPAuthToken(token))
+		q.Del("authToken")
+		u.RawQuery = q.Encode()
+	}
+	return NewHTTPConnector(u.String(), opts...)
+}
+
+// httpConn is the driver.Conn HTTPConnector.Connect returns. It is not safe
+// for concurrent use, per the driver.Conn contract.
+type httpConn struct {
+	connector *HTTPConnector
+
+	// pending buffers statements issued between BeginTx and Commit, sent as
+	// a single request when the transaction commits; nil outside a
+	// transaction.
+	pending []*httpPendingStatement
+}
+
+// httpPendingStatement is one statement buffered inside a transaction. Its
+// result is filled in once Commit's single HTTP round trip returns.
+type httpPendingStatement struct {
+	stmt   httpStatement
+	result httpDeferredResult
+}
+
+// errHTTPResultPending is what a tx-scoped statement's driver.Result
+// returns from LastInsertId/RowsAffected until the transaction that buffers
+// it actually commits. It must never block on Commit instead: Commit runs
+// on the same connection/goroutine the caller is already on (httpConn "is
+// not safe for concurrent use"), so a caller that reads the result before
+// committing -- an entirely ordinary thing to do -- would otherwise
+// deadlock waiting for a Commit call that can never happen.
+var errHTTPResultPending = fmt.Errorf("libsql+http: LastInsertId/RowsAffected are not available until the transaction commits")
+
+// httpDeferredResult is the driver.Result returned for a statement executed
+// inside a transaction: its fields aren't known until Commit runs the whole
+// batch, so LastInsertId/RowsAffected report errHTTPResultPending until
+// settle is called.
+type httpDeferredResult struct {
+	ready        bool
+	lastInsertID int64
+	rowsAffected int64
+	err          error
+}
+
+func (r *httpDeferredResult) settle(lastInsertID, rowsAffected int64, err error) {
+	r.ready = true
+	r.lastInsertID, r.rowsAffected, r.err = lastInsertID, rowsAffected, err
+}
+
+func (r *httpDeferredResult) LastInsertId() (int64, error) {
+	if !r.ready {
+		return 0, errHTTPResultPending
+	}
+	return r.lastInsertID, r.err
+}
+
+func (r *httpDeferredResult) RowsAffected() (int64, error) {
+	if !r.ready {
+		return 0, errHTTPResultPending
+	}
+	return r.rowsAffected, r.err
+}
+
+func (c *httpConn) Prepare(query string) (sqldriver.Stmt, error) {
+	return &httpStmt{conn: c, query: query}, nil
+}
+
+func (c *httpConn) Close() error {
+	return nil
+}
+
+func (c *httpConn) Begin() (sqldriver.Tx, error) {
+	return c.BeginTx(context.Background(), sqldriver.TxOptions{})
+}
+
+// BeginTx starts buffering statements issued on this connection instead of
+// sending each as its own request; Commit sends every buffered statement in
+// one HTTP round trip, chained with "ok" conditions so a failure partway
+// through skips (and reports an error for) the rest.
+func (c *httpConn) BeginTx(ctx context.Context, opts sqldriver.TxOptions) (sqldriver.Tx, error) {
+	if c.pending != nil {
+		return nil, fmt.Errorf("libsql+http: a transaction is already open on this connection")
+	}
+	c.pending = []*httpPendingStatement{}
+	return &httpTx{conn: c}, nil
+}
+
+func (c *httpConn) inTransaction() bool {
+	return c.pending != nil
+}
+
+func (c *httpConn) ExecContext(ctx context.Context, query string, args []sqldriver.NamedValue) (sqldriver.Result, error) {
+	stmt := httpStatement{query: query, params: httpParamsFromArgs(args)}
+	if c.inTransaction() {
+		pending := &httpPendingStatement{stmt: stmt}
+		c.pending = append(c.pending, pending)
+		return &pending.result, nil
+	}
+	results, err := c.connector.execBatch(ctx, []httpStatement{stmt})
+	if err != nil {
+		return nil, err
+	}
+	return results[0].asResult()
+}
+
+func (c *httpConn) QueryContext(ctx context.Context, query string, args []sqldriver.NamedValue) (sqldriver.Rows, error) {
+	if c.inTransaction() {
+		return nil, fmt.Errorf("libsql+http: queries are not supported inside an explicit transaction (rows can't be buffered for a later round trip); issue SELECTs outside BeginTx")
+	}
+	stmt := httpStatement{query: query, params: httpParamsFromArgs(args)}
+	results, err := c.connector.execBatch(ctx, []httpStatement{stmt})
+	if err != nil {
+		return nil, err
+	}
+	return results[0].asRows()
+}
+
+// httpTx is the driver.Tx BeginTx returns.
+type httpTx struct {
+	conn *httpConn
+}
+
+func (t *httpTx) Commit() error {
+	pending := t.conn.pending
+	t.conn.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+	statements := make([]httpStatement, len(pending))
+	for i, p := range pending {
+		statements[i] = p.stmt
+		if i > 0 {
+			statements[i].condition = &httpCondition{Type: "ok", Step: i - 1}
+		}
+	}
+	results, err := t.conn.connector.execBatch(context.Background(), statements)
+	if err != nil {
+		for _, p := range pending {
+			p.result.settle(0, 0, err)
+		}
+		return err
+	}
+	var firstErr error
+	for i, p := range pending {
+		res, err := results[i].asResult()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			p.result.settle(0, 0, err)
+			continue
+		}
+		lastID, _ := res.LastInsertId()
+		rows, _ := res.RowsAffected()
+		p.result.settle(lastID, rows, nil)
+	}
+	return firstErr
+}
+
+func (t *httpTx) Rollback() error {
+	pending := t.conn.pending
+	t.conn.pending = nil
+	for _, p := range pending {
+		p.result.settle(0, 0, fmt.Errorf("libsql+http: transaction rolled back"))
+	}
+	return nil
+}
+
+// httpStmt is the driver.Stmt Prepare returns. This driver has no server-
+// side prepared-statement concept, so it is a thin wrapper that replays the
+// query text through conn on every call.
+type httpStmt struct {
+	conn  *httpConn
+	query string
+}
+
+func (s *httpStmt) Close() error {
+	return nil
+}
+
+func (s *httpStmt) NumInput() int {
+	return -1 // Let database/sql skip argument-count validation; see driver.Stmt.
+}
+
+func (s *httpStmt) Exec(args []sqldriver.Value) (sqldriver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, namedFromValues(args))
+}
+
+func (s *httpStmt) Query(args []sqldriver.Value) (sqldriver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, namedFromValues(args))
+}
+
+func namedFromValues(args []sqldriver.Value) []sqldriver.NamedValue {
+	named := make([]sqldriver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = sqldriver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return named
+}
+
+// httpParams is the parameter payload for one statement: purely positional
+// arguments marshal as a bare JSON array, named ones as a "@name"-keyed
+// object -- the same shape the original tursohttp helper used.
+type httpParams struct {
+	names  []string
+	values []any
+}
+
+func httpParamsFromArgs(args []sqldriver.NamedValue) httpParams {
+	sorted := append([]sqldriver.NamedValue(nil), args...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Ordinal < sorted[j].Ordinal })
+	p := httpParams{values: make([]any, 0, len(sorted))}
+	for _, a := range sorted {
+		if a.Name != "" {
+			p.names = append(p.names, a.Name)
+		}
+		p.values = append(p.values, a.Value)
+	}
+	return p
+}
+
+func (p httpParams) MarshalJSON() ([]byte, error) {
+	if len(p.values) == 0 {
+		return json.Marshal([]string{})
+	}
+	if len(p.names) == 0 {
+		return json.Marshal(p.values)
+	}
+	named := make(map[string]any, len(p.values))
+	for i, v := range p.values {
+		named["@"+p.names[i]] = v
+	}
+	return json.Marshal(named)
+}
+
+// httpCondition gates a batched statement on an earlier one's outcome; see
+// the file-level comment for the wire format.
+type httpCondition struct {
+	Type string `json:"type"`
+	Step int    `json:"step"`
+}
+
+// httpStatement is one statement sent to the batch endpoint.
+type httpStatement struct {
+	query     string
+	params    httpParams
+	condition *httpCondition
+}
+
+func (s httpStatement) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Query     string         `json:"q"`
+		Params    httpParams     `json:"params"`
+		Condition *httpCondition `json:"condition,omitempty"`
+	}{Query: s.query, Params: s.params, Condition: s.condition})
+}
+
+// httpResultSet is a statement's column/row data, as returned for a
+// "results" entry in the batch response.
+type httpResultSet struct {
+	Columns      []string `json:"columns"`
+	Rows         [][]any  `json:"rows"`
+	LastInsertID int64    `json:"last_insert_rowid"`
+	RowsAffected int64    `json:"rows_affected"`
+}
+
+type httpErrorObject struct {
+	Message string `json:"message"`
+}
+
+// httpStatementResult is one entry in the batch response: exactly one of
+// Results or Error is set.
+type httpStatementResult struct {
+	Results *httpResultSet   `json:"results"`
+	Error   *httpErrorObject `json:"error"`
+}
+
+func (r httpStatementResult) asResult() (sqldriver.Result, error) {
+	if r.Error != nil {
+		return nil, fmt.Errorf("libsql+http: %s", r.Error.Message)
+	}
+	return &httpResult{lastInsertID: r.Results.LastInsertID, rowsAffected: r.Results.RowsAffected}, nil
+}
+
+func (r httpStatementResult) asRows() (sqldriver.Rows, error) {
+	if r.Error != nil {
+		return nil, fmt.Errorf("libsql+http: %s", r.Error.Message)
+	}
+	return &httpRows{result: r.Results}, nil
+}
+
+type httpResult struct {
+	lastInsertID int64
+	rowsAffected int64
+}
+
+func (r *httpResult) LastInsertId() (int64, error) { return r.lastInsertID, nil }
+func (r *httpResult) RowsAffected() (int64, error) { return r.rowsAffected, nil }
+
+// httpRows is the driver.Rows an HTTP query returns; all rows are already
+// buffered in memory from the single JSON response, so Close is a no-op.
+type httpRows struct {
+	result *httpResultSet
+	next   int
+}
+
+func (r *httpRows) Columns() []string {
+	return r.result.Columns
+}
+
+func (r *httpRows) Close() error {
+	return nil
+}
+
+func (r *httpRows) Next(dest []sqldriver.Value) error {
+	if r.next >= len(r.result.Rows) {
+		return io.EOF
+	}
+	row := r.result.Rows[r.next]
+	for i := range dest {
+		dest[i] = row[i]
+	}
+	r.next++
+	return nil
+}
+
+// execBatch posts statements to c.url in a single request and returns one
+// httpStatementResult per statement, retrying on a 5xx response.
+func (c *HTTPConnector) execBatch(ctx context.Context, statements []httpStatement) ([]httpStatementResult, error) {
+	body, err := json.Marshal(struct {
+		Statements []httpStatement `json:"statements"`
+	}{Statements: statements})
+	if err != nil {
+		return nil, fmt.Errorf("libsql+http: marshaling request: %w", err)
+	}
+
+	var results []httpStatementResult
+	err = withHTTPRetry(ctx, c.maxRetries, func() (retryable bool, err error) {
+		req, err := c.newRequest(ctx, body)
+		if err != nil {
+			return false, err
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return true, fmt.Errorf("libsql+http: request failed: %w", err)
+		}
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return true, fmt.Errorf("libsql+http: reading response: %w", err)
+		}
+		if resp.StatusCode >= 500 {
+			return true, fmt.Errorf("libsql+http: server error %d: %s", resp.StatusCode, string(respBody))
+		}
+		if resp.StatusCode != http.StatusOK {
+			return false, fmt.Errorf("libsql+http: unexpected status %d: %s", resp.StatusCode, string(respBody))
+		}
+		var parsed []httpStatementResult
+		if err := json.Unmarshal(respBody, &parsed); err != nil {
+			return false, fmt.Errorf("libsql+http: decoding response: %w", err)
+		}
+		results = parsed
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != len(statements) {
+		return nil, fmt.Errorf("libsql+http: expected %d results, got %d", len(statements), len(results))
+	}
+	return results, nil
+}
+
+// newRequest builds a POST request for body, gzip-compressing it when it's
+// large enough to be worth the CPU, and attaching the Bearer token if one
+// was configured. The client relies on net/http's built-in transparent
+// gzip response decompression (automatic as long as no caller-set
+// Accept-Encoding header is present), so only the request side needs
+// explicit handling here.
+func (c *HTTPConnector) newRequest(ctx context.Context, body []byte) (*http.Request, error) {
+	const gzipThreshold = 1024
+	contentEncoding := ""
+	if len(body) >= gzipThreshold {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		if _, err := gw.Write(body); err != nil {
+			return nil, fmt.Errorf("libsql+http: gzipping request: %w", err)
+		}
+		if err := gw.Close(); err != nil {
+			return nil, fmt.Errorf("libsql+http: gzipping request: %w", err)
+		}
+		body = buf.Bytes()
+		contentEncoding = "gzip"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("libsql+http: building request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	if c.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.authToken)
+	}
+	return req, nil
+}
+
+// withHTTPRetry calls attempt up to maxRetries+1 times, stopping as soon as
+// it returns retryable == false (whether or not err is nil), or ctx is
+// done. Backoff between attempts is exponential with jitter, mirroring
+// syncBackoff's shape.
+func withHTTPRetry(ctx context.Context, maxRetries int, attempt func() (retryable bool, err error)) error {
+	var err error
+	for i := 0; ; i++ {
+		var retryable bool
+		retryable, err = attempt()
+		if !retryable || i >= maxRetries {
+			return err
+		}
+		delay := httpRetryBackoff(i + 1)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func httpRetryBackoff(attempt int) time.Duration {
+	const (
+		base    = 100 * time.Millisecond
+		maxWait = 5 * time.Second
+	)
+	d := base << attempt
+	if d <= 0 || d > maxWait {
+		d = maxWait
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}
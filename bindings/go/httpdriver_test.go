@@ -0,0 +1,362 @@
+package libsql
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// decodeHTTPRequestBody transparently gunzips req's body if it was sent
+// Content-Encoding: gzip, mirroring what a real Hrana-style HTTP endpoint
+// would do.
+func decodeHTTPRequestBody(t *testing.T, r *http.Request) []byte {
+	t.Helper()
+	var reader io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatalf("gzip.NewReader: %v", err)
+		}
+		defer gr.Close()
+		reader = gr
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading request body: %v", err)
+	}
+	return body
+}
+
+type fakeStatement struct {
+	Query  string `json:"q"`
+	Params any    `json:"params"`
+}
+
+func fakeServer(t *testing.T, handler func(statements []fakeStatement) []httpStatementResult) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := decodeHTTPRequestBody(t, r)
+		var req struct {
+			Statements []fakeStatement `json:"statements"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Fatalf("unmarshaling request: %v", err)
+		}
+		results := handler(req.Statements)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(results); err != nil {
+			t.Fatalf("encoding response: %v", err)
+		}
+	}))
+}
+
+func TestHTTPDriverExecAndQuery(t *testing.T) {
+	srv := fakeServer(t, func(statements []fakeStatement) []httpStatementResult {
+		if len(statements) != 1 {
+			t.Fatalf("expected 1 statement, got %d", len(statements))
+		}
+		if strings.HasPrefix(statements[0].Query, "SELECT") {
+			return []httpStatementResult{{Results: &httpResultSet{
+				Columns: []string{"n"},
+				Rows:    [][]any{{float64(42)}},
+			}}}
+		}
+		return []httpStatementResult{{Results: &httpResultSet{LastInsertID: 7, RowsAffected: 1}}}
+	})
+	defer srv.Close()
+
+	db := sql.OpenDB(mustHTTPConnector(t, srv.URL))
+	defer db.Close()
+
+	res, err := db.Exec("INSERT INTO t VALUES (1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := res.LastInsertId(); id != 7 {
+		t.Fatalf("expected LastInsertId 7, got %d", id)
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		t.Fatalf("expected RowsAffected 1, got %d", n)
+	}
+
+	var n int
+	if err := db.QueryRow("SELECT n FROM t").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 42 {
+		t.Fatalf("expected 42, got %d", n)
+	}
+}
+
+func TestHTTPDriverAuthToken(t *testing.T) {
+	var gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		io.ReadAll(r.Body)
+		json.NewEncoder(w).Encode([]httpStatementResult{{Results: &httpResultSet{}}})
+	}))
+	defer srv.Close()
+
+	connector, err := NewHTTPConnector(srv.URL, WithHTTPAuthToken("secret-token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	if _, err := db.Exec("SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+	if gotAuth != "Bearer secret-token" {
+		t.Fatalf("expected Bearer secret-token, got %q", gotAuth)
+	}
+}
+
+func TestHTTPDriverTransactionBatchesIntoOneRoundTrip(t *testing.T) {
+	var requestCount int32
+	srv := fakeServer(t, func(statements []fakeStatement) []httpStatementResult {
+		atomic.AddInt32(&requestCount, 1)
+		if len(statements) != 2 {
+			t.Fatalf("expected both statements in one batch, got %d", len(statements))
+		}
+		return []httpStatementResult{
+			{Results: &httpResultSet{RowsAffected: 1}},
+			{Results: &httpResultSet{RowsAffected: 1}},
+		}
+	})
+	defer srv.Close()
+
+	db := sql.OpenDB(mustHTTPConnector(t, srv.URL))
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("INSERT INTO t VALUES (2)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&requestCount); got != 1 {
+		t.Fatalf("expected exactly 1 HTTP round trip for the whole transaction, got %d", got)
+	}
+}
+
+// TestHTTPDriverTxResultDoesNotBlockBeforeCommit guards against the
+// ordinary pattern "res, _ := tx.Exec(...); res.LastInsertId(); tx.Commit()"
+// deadlocking: LastInsertId/RowsAffected on a tx-scoped Exec's result must
+// never block waiting for Commit, since Commit runs on the same connection/
+// goroutine and can never be called while that goroutine is itself blocked
+// reading the result.
+func TestHTTPDriverTxResultDoesNotBlockBeforeCommit(t *testing.T) {
+	srv := fakeServer(t, func(statements []fakeStatement) []httpStatementResult {
+		return []httpStatementResult{{Results: &httpResultSet{LastInsertID: 9, RowsAffected: 1}}}
+	})
+	defer srv.Close()
+
+	db := sql.OpenDB(mustHTTPConnector(t, srv.URL))
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO t VALUES (1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := res.LastInsertId(); err == nil {
+			t.Error("expected an error reading LastInsertId before Commit, got nil")
+		}
+		if _, err := res.RowsAffected(); err == nil {
+			t.Error("expected an error reading RowsAffected before Commit, got nil")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("LastInsertId/RowsAffected blocked instead of returning immediately before Commit")
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := res.LastInsertId(); err != nil || id != 9 {
+		t.Fatalf("expected LastInsertId 9 after Commit, got %d, %v", id, err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		t.Fatalf("expected RowsAffected 1 after Commit, got %d, %v", n, err)
+	}
+}
+
+func TestHTTPDriverTransactionStepConditionChaining(t *testing.T) {
+	var gotConditions []any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := decodeHTTPRequestBody(t, r)
+		var req struct {
+			Statements []struct {
+				Condition any `json:"condition"`
+			} `json:"statements"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Fatalf("unmarshaling request: %v", err)
+		}
+		for _, s := range req.Statements {
+			gotConditions = append(gotConditions, s.Condition)
+		}
+		results := make([]httpStatementResult, len(req.Statements))
+		for i := range results {
+			results[i] = httpStatementResult{Results: &httpResultSet{RowsAffected: 1}}
+		}
+		json.NewEncoder(w).Encode(results)
+	}))
+	defer srv.Close()
+
+	db := sql.OpenDB(mustHTTPConnector(t, srv.URL))
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := tx.Exec("INSERT INTO t VALUES (?)", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(gotConditions) != 3 {
+		t.Fatalf("expected 3 statements, got %d", len(gotConditions))
+	}
+	if gotConditions[0] != nil {
+		t.Fatalf("expected the first statement to carry no condition, got %v", gotConditions[0])
+	}
+	for i := 1; i < 3; i++ {
+		cond, ok := gotConditions[i].(map[string]any)
+		if !ok {
+			t.Fatalf("statement %d: expected a condition object, got %v", i, gotConditions[i])
+		}
+		if cond["type"] != "ok" || int(cond["step"].(float64)) != i-1 {
+			t.Fatalf("statement %d: expected {ok, step %d}, got %v", i, i-1, cond)
+		}
+	}
+}
+
+func TestHTTPDriverRollbackDiscardsBufferedStatements(t *testing.T) {
+	var requestCount int32
+	srv := fakeServer(t, func(statements []fakeStatement) []httpStatementResult {
+		atomic.AddInt32(&requestCount, 1)
+		return nil
+	})
+	defer srv.Close()
+
+	db := sql.OpenDB(mustHTTPConnector(t, srv.URL))
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&requestCount); got != 0 {
+		t.Fatalf("expected no HTTP request for a rolled-back transaction, got %d", got)
+	}
+}
+
+func TestHTTPDriverRetriesOn5xx(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode([]httpStatementResult{{Results: &httpResultSet{RowsAffected: 1}}})
+	}))
+	defer srv.Close()
+
+	connector, err := NewHTTPConnector(srv.URL, WithHTTPMaxRetries(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	if _, err := db.Exec("INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&attempts); got != 3 {
+		t.Fatalf("expected 3 attempts (2 failures then a success), got %d", got)
+	}
+}
+
+func TestHTTPDriverGzipsLargeRequests(t *testing.T) {
+	var gotEncoding string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotEncoding = r.Header.Get("Content-Encoding")
+		decodeHTTPRequestBody(t, r)
+		json.NewEncoder(w).Encode([]httpStatementResult{{Results: &httpResultSet{RowsAffected: 1}}})
+	}))
+	defer srv.Close()
+
+	db := sql.OpenDB(mustHTTPConnector(t, srv.URL))
+	defer db.Close()
+	if _, err := db.Exec("INSERT INTO t VALUES (?)", strings.Repeat("x", 4096)); err != nil {
+		t.Fatal(err)
+	}
+	if gotEncoding != "gzip" {
+		t.Fatalf("expected a gzipped request body, got Content-Encoding %q", gotEncoding)
+	}
+}
+
+func TestHTTPDriverQueryInsideTransactionErrors(t *testing.T) {
+	srv := fakeServer(t, func(statements []fakeStatement) []httpStatementResult {
+		t.Fatal("no HTTP request should be made for an unsupported in-transaction query")
+		return nil
+	})
+	defer srv.Close()
+
+	db := sql.OpenDB(mustHTTPConnector(t, srv.URL))
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Query("SELECT 1"); err == nil {
+		t.Fatal("expected an error querying inside an explicit transaction")
+	}
+}
+
+func mustHTTPConnector(t *testing.T, url string) *HTTPConnector {
+	t.Helper()
+	connector, err := NewHTTPConnector(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return connector
+}
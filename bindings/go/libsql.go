@@ -15,6 +15,8 @@ import "C"
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
 	sqldriver "database/sql/driver"
 	"errors"
@@ -23,9 +25,14 @@ import (
 	"github.com/libsql/sqlite-antlr4-parser/sqliteparser"
 	"github.com/libsql/sqlite-antlr4-parser/sqliteparserutils"
 	"io"
+	"math"
 	"net/url"
 	"regexp"
+	"runtime/cgo"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unsafe"
 )
@@ -35,10 +42,19 @@ func init() {
 }
 
 type config struct {
-	authToken      *string
-	readYourWrites *bool
-	encryptionKey  *string
-	syncInterval   *time.Duration
+	authToken          *string
+	readYourWrites     *bool
+	encryptionKey      *string
+	syncInterval       *time.Duration
+	tlsConfig          *tls.Config
+	sslMode            *string
+	syncHook           func(SyncEvent)
+	statementCacheSize *int
+	maxRetries         *int
+	retryBackoff       BackoffFunc
+	isRetryableErr     func(error) bool
+	timeFormat         *TimeFormat
+	timeLocation       *time.Location
 }
 
 type Option interface {
@@ -97,6 +113,107 @@ func WithSyncInterval(interval time.Duration) Option {
 	})
 }
 
+// WithSyncHook registers a callback invoked around every sync this
+// Connector performs against its primary, whether triggered by
+// WithSyncInterval's background goroutine or an explicit Sync call. hook is
+// called once with SyncPhaseStart before the sync begins and once more with
+// SyncPhaseSuccess or SyncPhaseError once it completes; see SyncEvent. hook
+// is called synchronously from the syncing goroutine, so it must not block
+// or call back into the Connector.
+func WithSyncHook(hook func(SyncEvent)) Option {
+	return option(func(o *config) error {
+		if hook == nil {
+			return fmt.Errorf("sync hook must not be nil")
+		}
+		o.syncHook = hook
+		return nil
+	})
+}
+
+// WithStatementCacheSize overrides the number of prepared native statements
+// each connection opened from this Connector keeps around for reuse, keyed
+// by SQL text. The default is 100; 0 disables the cache so every execution
+// prepares and frees its own statement, as the driver did before this option
+// existed. See also WithoutStatementCache for bypassing the cache on
+// individual queries, and Stats for inspecting a connection's cache
+// effectiveness.
+func WithStatementCacheSize(n int) Option {
+	return option(func(o *config) error {
+		if n < 0 {
+			return fmt.Errorf("statement cache size must not be negative")
+		}
+		o.statementCacheSize = &n
+		return nil
+	})
+}
+
+// WithTLSConfig sets the TLS configuration used when dialing primaryUrl. It
+// is the general escape hatch; WithRootCAs, WithClientCertificate and
+// WithSSLMode are sugar on top of it and may be combined with it or with
+// each other, applied in the order the options are passed to
+// NewEmbeddedReplicaConnector.
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return option(func(o *config) error {
+		if tlsConfig == nil {
+			return fmt.Errorf("tls config must not be nil")
+		}
+		o.tlsConfig = tlsConfig.Clone()
+		return nil
+	})
+}
+
+// WithRootCAs restricts certificate validation of the primary's TLS
+// certificate to the given pool of root CAs, instead of the host's default
+// trust store. Useful when primaryUrl points at a self-hosted sqld behind a
+// private CA.
+func WithRootCAs(pool *x509.CertPool) Option {
+	return option(func(o *config) error {
+		if pool == nil {
+			return fmt.Errorf("root CA pool must not be nil")
+		}
+		o.ensureTLSConfig().RootCAs = pool
+		return nil
+	})
+}
+
+// WithClientCertificate presents cert during the TLS handshake with the
+// primary, for mutual-TLS gateways that require client authentication.
+func WithClientCertificate(cert tls.Certificate) Option {
+	return option(func(o *config) error {
+		cfg := o.ensureTLSConfig()
+		cfg.Certificates = append(cfg.Certificates, cert)
+		return nil
+	})
+}
+
+// WithSSLMode picks a certificate-validation strategy using the same
+// taxonomy as Postgres' sslmode: "disable" sends the primary URL unencrypted,
+// "require" encrypts the connection but performs no certificate validation
+// at all, "verify-ca" validates the certificate chain against the configured
+// roots (see WithRootCAs) but skips hostname verification, and "verify-full"
+// (the default) validates both the chain and the hostname.
+func WithSSLMode(mode string) Option {
+	return option(func(o *config) error {
+		if o.sslMode != nil {
+			return fmt.Errorf("ssl mode already set")
+		}
+		switch mode {
+		case "disable", "require", "verify-ca", "verify-full":
+		default:
+			return fmt.Errorf(`ssl mode must be one of "disable", "require", "verify-ca" or "verify-full", got %q`, mode)
+		}
+		o.sslMode = &mode
+		return nil
+	})
+}
+
+func (o *config) ensureTLSConfig() *tls.Config {
+	if o.tlsConfig == nil {
+		o.tlsConfig = &tls.Config{}
+	}
+	return o.tlsConfig
+}
+
 func NewEmbeddedReplicaConnector(dbPath string, primaryUrl string, opts ...Option) (*Connector, error) {
 	var config config
 	errs := make([]error, 0, len(opts))
@@ -124,7 +241,40 @@ func NewEmbeddedReplicaConnector(dbPath string, primaryUrl string, opts ...Optio
 	if config.syncInterval != nil {
 		syncInterval = *config.syncInterval
 	}
-	return openEmbeddedReplicaConnector(dbPath, primaryUrl, authToken, readYourWrites, encryptionKey, syncInterval)
+	sslMode := ""
+	if config.sslMode != nil {
+		sslMode = *config.sslMode
+	}
+	tlsConfig := config.tlsConfig
+	if tlsConfig != nil || sslMode != "" {
+		if err := preflightTLS(primaryUrl, resolveTLSConfig(tlsConfig, sslMode)); err != nil {
+			return nil, err
+		}
+	}
+	statementCacheSize := defaultStatementCacheSize
+	if config.statementCacheSize != nil {
+		statementCacheSize = *config.statementCacheSize
+	}
+	c, err := openEmbeddedReplicaConnector(dbPath, primaryUrl, authToken, readYourWrites, encryptionKey, syncInterval, tlsConfig, sslMode, config.syncHook, statementCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	if config.maxRetries != nil {
+		c.retryPolicy.maxRetries = *config.maxRetries
+	}
+	if config.retryBackoff != nil {
+		c.retryPolicy.backoff = config.retryBackoff
+	}
+	if config.isRetryableErr != nil {
+		c.retryPolicy.isRetryable = config.isRetryableErr
+	}
+	if config.timeFormat != nil {
+		c.timeFormat = *config.timeFormat
+	}
+	if config.timeLocation != nil {
+		c.timeLocation = config.timeLocation
+	}
+	return c, nil
 }
 
 type driver struct{}
@@ -137,44 +287,300 @@ func (d driver) Open(dbAddress string) (sqldriver.Conn, error) {
 	return connector.Connect(context.Background())
 }
 
+// OpenConnector dispatches dbAddress to whichever scheme opens it: a scheme
+// added with RegisterScheme if one matches, otherwise ParseDSN's Config for
+// the built-in local (file:/:memory:), embedded replica (libsql:// with
+// replicaPath), and pure remote (libsql://, http://, https://) DSNs; see
+// Config.Connector. An address whose scheme is neither reports an
+// *UnsupportedSchemeError.
 func (d driver) OpenConnector(dbAddress string) (sqldriver.Connector, error) {
-	if strings.HasPrefix(dbAddress, ":memory:") {
-		return openLocalConnector(dbAddress)
+	if opener, ok := registeredSchemeOpener(dbAddress); ok {
+		return opener(dbAddress)
 	}
-	u, err := url.Parse(dbAddress)
+	cfg, err := ParseDSN(dbAddress)
 	if err != nil {
 		return nil, err
 	}
-	switch u.Scheme {
-	case "file":
-		return openLocalConnector(dbAddress)
-	case "http":
-		fallthrough
-	case "https":
-		fallthrough
-	case "libsql":
-		authToken := u.Query().Get("authToken")
-		u.RawQuery = ""
-		return openRemoteConnector(u.String(), authToken)
+	return cfg.Connector()
+}
+
+// SyncPhase identifies which stage of a sync a SyncEvent describes.
+type SyncPhase int
+
+const (
+	// SyncPhaseStart is reported once, before a sync with the primary begins.
+	SyncPhaseStart SyncPhase = iota
+	// SyncPhaseSuccess is reported once a sync completes without error.
+	SyncPhaseSuccess
+	// SyncPhaseError is reported once a sync fails; SyncEvent.Err holds the cause.
+	SyncPhaseError
+)
+
+func (p SyncPhase) String() string {
+	switch p {
+	case SyncPhaseStart:
+		return "start"
+	case SyncPhaseSuccess:
+		return "success"
+	case SyncPhaseError:
+		return "error"
+	default:
+		return "unknown"
 	}
-	return nil, fmt.Errorf("unsupported URL scheme: %s\nThis driver supports only URLs that start with libsql://, file:, https:// or http://", u.Scheme)
 }
 
-func libsqlSync(nativeDbPtr C.libsql_database_t) error {
+// SyncEvent describes one step of an embedded replica's sync with its
+// primary, delivered to the hook registered with WithSyncHook.
+// FrameNoBefore and FrameNoAfter are only meaningful once Phase is
+// SyncPhaseSuccess; FramesApplied and Duration cover the whole sync and are
+// zero on SyncPhaseStart.
+type SyncEvent struct {
+	Phase         SyncPhase
+	FrameNoBefore uint64
+	FrameNoAfter  uint64
+	FramesApplied uint64
+	Duration      time.Duration
+	Err           error
+	// Changes is always empty: see SubscribeOptions.IncludeChanges.
+	Changes []RowChange
+}
+
+// RowChange describes one row touched by a sync. It is reserved for
+// SubscribeOptions.IncludeChanges, which is not currently implemented; see
+// Subscribe.
+type RowChange struct {
+	Table string
+	RowID int64
+	Op    string
+}
+
+// SubscribeOptions configures Subscribe.
+type SubscribeOptions struct {
+	// IncludeChanges asks Subscribe to populate each SyncEvent's Changes
+	// with the rows touched while applying that sync's frames. Not
+	// currently implemented -- see Subscribe -- so Subscribe rejects it
+	// rather than silently always delivering an empty Changes.
+	IncludeChanges bool
+}
+
+// syncSubscriber is one outstanding Subscribe call.
+type syncSubscriber struct {
+	ch   chan SyncEvent
+	done chan struct{}
+}
+
+// Subscribe returns a channel that receives a SyncEvent after every
+// successful sync against the primary, whether driven by auto-sync (see
+// WithSyncInterval), a manual Sync, or TriggerSync -- a pq.Listener-style
+// push alternative to polling SELECT in a loop for cache invalidation or
+// reactive UI updates. The channel is closed once ctx is done or c is
+// closed. Each subscriber has a small buffer; an event is dropped rather
+// than queued for a subscriber that isn't keeping up, since a cache
+// invalidation signal is still useful late but a backed-up channel must
+// never stall syncing.
+//
+// opts.IncludeChanges is not currently supported: libsql_sync_with_frame_no
+// has no hook for the rows touched while applying replicated frames (only
+// conn-level SQL execution goes through UpdateHook/PreUpdateHook, which
+// sync does not run through), so there is no way to populate
+// SyncEvent.Changes yet. Passing IncludeChanges returns an error instead of
+// silently leaving Changes empty.
+func (c *Connector) Subscribe(ctx context.Context, opts SubscribeOptions) (<-chan SyncEvent, error) {
+	if opts.IncludeChanges {
+		return nil, fmt.Errorf("libsql: Subscribe: IncludeChanges is not supported")
+	}
+	sub := &syncSubscriber{ch: make(chan SyncEvent, 8), done: make(chan struct{})}
+	c.subscribersMu.Lock()
+	c.subscribers = append(c.subscribers, sub)
+	c.subscribersMu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-sub.done:
+		}
+		c.subscribersMu.Lock()
+		for i, s := range c.subscribers {
+			if s == sub {
+				c.subscribers = append(c.subscribers[:i], c.subscribers[i+1:]...)
+				break
+			}
+		}
+		c.subscribersMu.Unlock()
+		close(sub.ch)
+	}()
+
+	return sub.ch, nil
+}
+
+// publishSyncEvent delivers event to every live Subscribe channel,
+// non-blocking: a subscriber whose buffer is full misses this event rather
+// than stalling the sync that produced it.
+func (c *Connector) publishSyncEvent(event SyncEvent) {
+	c.subscribersMu.Lock()
+	defer c.subscribersMu.Unlock()
+	for _, sub := range c.subscribers {
+		select {
+		case sub.ch <- event:
+		default:
+		}
+	}
+}
+
+// SyncStats holds cumulative replication counters for a Connector, as
+// returned by Connector.Stats.
+type SyncStats struct {
+	SyncCount     uint64
+	ErrorCount    uint64
+	FramesApplied uint64
+	// LastFrameNo is the primary frame number the replica had applied up to
+	// as of the most recent successful sync. WaitForFrame blocks on it.
+	LastFrameNo uint64
+	LastSyncAt  time.Time
+}
+
+// libsqlSyncWithFrameNo syncs nativeDbPtr against its primary, additionally
+// reporting the replica's frame number after the sync and how many frames
+// were applied during it, so callers can drive SyncEvent and SyncStats.
+func libsqlSyncWithFrameNo(nativeDbPtr C.libsql_database_t) (frameNo uint64, framesApplied uint64, err error) {
 	var errMsg *C.char
-	statusCode := C.libsql_sync(nativeDbPtr, &errMsg)
+	var frameNoNative C.ulonglong
+	var framesAppliedNative C.ulonglong
+	statusCode := C.libsql_sync_with_frame_no(nativeDbPtr, &frameNoNative, &framesAppliedNative, &errMsg)
 	if statusCode != 0 {
-		return libsqlError("failed to sync database ", statusCode, errMsg)
+		return 0, 0, libsqlError("failed to sync database ", statusCode, errMsg)
 	}
-	return nil
+	return uint64(frameNoNative), uint64(framesAppliedNative), nil
+}
+
+// connParams holds the pool-wide defaults parsed from a file/memory DSN's
+// "_"-prefixed query parameters (see parseConnParams), applied to every
+// physical connection openLocalConnector's Connector opens.
+type connParams struct {
+	txLock        string
+	journalMode   string
+	busyTimeout   string
+	foreignKeys   string
+	synchronous   string
+	cacheSize     string
+	stmtCacheSize *int
+	maxRetries    *int
+	retryBackoff  string
+}
+
+var validTxLocks = map[string]bool{"deferred": true, "immediate": true, "exclusive": true}
+
+var validRetryBackoffs = map[string]bool{"exponential": true, "none": true}
+
+// parseConnParams recognizes _txlock, _journal_mode, _busy_timeout,
+// _foreign_keys, _synchronous, _cache_size, _stmt_cache_size, _max_retries,
+// and _retry_backoff; any other "_"-prefixed key is rejected so a typo
+// (e.g. "_busy_timout") fails at open time instead of silently being
+// ignored. Query parameters without a leading underscore are left to the
+// caller and ignored here.
+func parseConnParams(query url.Values) (*connParams, error) {
+	params := &connParams{}
+	for key, values := range query {
+		if !strings.HasPrefix(key, "_") {
+			continue
+		}
+		value := values[len(values)-1]
+		switch key {
+		case "_txlock":
+			if !validTxLocks[value] {
+				return nil, fmt.Errorf("unknown _txlock value %q: must be one of deferred, immediate, exclusive", value)
+			}
+			params.txLock = value
+		case "_journal_mode":
+			params.journalMode = value
+		case "_busy_timeout":
+			params.busyTimeout = value
+		case "_foreign_keys":
+			params.foreignKeys = value
+		case "_synchronous":
+			params.synchronous = value
+		case "_cache_size":
+			params.cacheSize = value
+		case "_stmt_cache_size":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid _stmt_cache_size value %q: must be a non-negative integer", value)
+			}
+			params.stmtCacheSize = &n
+		case "_max_retries":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid _max_retries value %q: must be a non-negative integer", value)
+			}
+			params.maxRetries = &n
+		case "_retry_backoff":
+			if !validRetryBackoffs[value] {
+				return nil, fmt.Errorf("unknown _retry_backoff value %q: must be one of exponential, none", value)
+			}
+			params.retryBackoff = value
+		default:
+			return nil, fmt.Errorf("unknown connection parameter %q", key)
+		}
+	}
+	return params, nil
+}
+
+// pragmas returns the PRAGMA statements that must run against every newly
+// opened physical connection so it honors the options in the DSN.
+func (p *connParams) pragmas() []string {
+	var stmts []string
+	for pragma, value := range map[string]string{
+		"journal_mode": p.journalMode,
+		"busy_timeout": p.busyTimeout,
+		"foreign_keys": p.foreignKeys,
+		"synchronous":  p.synchronous,
+		"cache_size":   p.cacheSize,
+	} {
+		if value != "" {
+			stmts = append(stmts, fmt.Sprintf("PRAGMA %s=%s", pragma, value))
+		}
+	}
+	sort.Strings(stmts)
+	return stmts
+}
+
+// splitDSNQuery separates a DSN's base (scheme, path, or ":memory:") from
+// its query string, without requiring the base itself to be a valid URL --
+// ":memory:" is not one.
+func splitDSNQuery(dbAddress string) (string, url.Values, error) {
+	base, rawQuery, found := strings.Cut(dbAddress, "?")
+	if !found {
+		return base, url.Values{}, nil
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", nil, err
+	}
+	return base, query, nil
 }
 
 func openLocalConnector(dbPath string) (*Connector, error) {
-	nativeDbPtr, err := libsqlOpenLocal(dbPath)
+	base, query, err := splitDSNQuery(dbPath)
 	if err != nil {
 		return nil, err
 	}
-	return &Connector{nativeDbPtr: nativeDbPtr}, nil
+	params, err := parseConnParams(query)
+	if err != nil {
+		return nil, err
+	}
+	nativeDbPtr, err := libsqlOpenLocal(base)
+	if err != nil {
+		return nil, err
+	}
+	c := newConnector(nativeDbPtr)
+	c.connParams = params
+	if params.stmtCacheSize != nil {
+		c.statementCacheSize = *params.stmtCacheSize
+	}
+	if params.maxRetries != nil || params.retryBackoff != "" {
+		c.retryPolicy = params.applyRetryParams(c.retryPolicy)
+	}
+	return c, nil
 }
 
 func openRemoteConnector(primaryUrl, authToken string) (*Connector, error) {
@@ -182,65 +588,244 @@ func openRemoteConnector(primaryUrl, authToken string) (*Connector, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Connector{nativeDbPtr: nativeDbPtr}, nil
+	c := newConnector(nativeDbPtr)
+	c.remote = true
+	return c, nil
 }
 
-func openEmbeddedReplicaConnector(dbPath, primaryUrl, authToken string, readYourWrites bool, encryptionKey string, syncInterval time.Duration) (*Connector, error) {
-	var closeCh chan struct{}
-	var closeAckCh chan struct{}
-	nativeDbPtr, err := libsqlOpenWithSync(dbPath, primaryUrl, authToken, readYourWrites, encryptionKey)
+func openEmbeddedReplicaConnector(dbPath, primaryUrl, authToken string, readYourWrites bool, encryptionKey string, syncInterval time.Duration, tlsConfig *tls.Config, sslMode string, syncHook func(SyncEvent), statementCacheSize int) (*Connector, error) {
+	nativeDbPtr, err := libsqlOpenWithSyncTLS(dbPath, primaryUrl, authToken, readYourWrites, encryptionKey, tlsConfig, sslMode)
 	if err != nil {
 		return nil, err
 	}
-	if err := libsqlSync(nativeDbPtr); err != nil {
+	c := newConnector(nativeDbPtr)
+	c.primaryUrl = primaryUrl
+	c.syncHook = syncHook
+	c.statementCacheSize = statementCacheSize
+	if err := c.syncOnce(); err != nil {
 		C.libsql_close(nativeDbPtr)
 		return nil, err
 	}
 	if syncInterval != 0 {
-		closeCh = make(chan struct{}, 1)
-		closeAckCh = make(chan struct{}, 1)
-		go func() {
-			for {
-				timerCh := make(chan struct{}, 1)
-				go func() {
-					time.Sleep(syncInterval)
-					timerCh <- struct{}{}
-				}()
-				select {
-				case <-closeCh:
-					closeAckCh <- struct{}{}
-					return
-				case <-timerCh:
-					if err := libsqlSync(nativeDbPtr); err != nil {
-						fmt.Println(err)
-					}
-				}
-			}
-		}()
-	}
-	if err != nil {
-		return nil, err
+		c.syncManager = newSyncManager(c, syncInterval)
 	}
-	return &Connector{nativeDbPtr: nativeDbPtr, closeCh: closeCh, closeAckCh: closeAckCh}, nil
+	return c, nil
 }
 
 type Connector struct {
 	nativeDbPtr C.libsql_database_t
-	closeCh     chan<- struct{}
-	closeAckCh  <-chan struct{}
+	// syncManager is non-nil for an embedded replica Connector opened with a
+	// non-zero syncInterval; it owns the periodic sync goroutine. See
+	// TriggerSync and syncManager.
+	syncManager *syncManager
+	remote      bool
+	// primaryUrl is set only for an embedded replica Connector (see
+	// openEmbeddedReplicaConnector); BulkInsert uses it to refuse writes with
+	// a message pointing at the primary instead of silently forwarding a
+	// large batched INSERT over Sync's frame-by-frame replication path.
+	primaryUrl string
+
+	funcsMu sync.Mutex
+	funcs   []registeredFunction
+
+	collationsMu sync.Mutex
+	collations   []registeredCollation
+
+	syncHook  func(SyncEvent)
+	statsMu   sync.Mutex
+	stats     SyncStats
+	frameCond *sync.Cond
+
+	// subscribersMu guards subscribers; see Subscribe.
+	subscribersMu sync.Mutex
+	subscribers   []*syncSubscriber
+
+	// writeTxLock keeps Sync from racing an in-flight write transaction on
+	// any conn this Connector has opened: a top-level, non-read-only
+	// BeginTx holds it RLocked for the transaction's lifetime (see
+	// conn.BeginTx), and Sync takes it Locked around the actual sync,
+	// blocking until every such transaction has committed or rolled back
+	// and holding off any that try to start in the meantime.
+	writeTxLock sync.RWMutex
+
+	// connParams is only set by openLocalConnector; it carries the DSN's
+	// "_"-prefixed query parameters down to every connection this Connector
+	// opens.
+	connParams *connParams
+
+	hooksMu       sync.Mutex
+	updateHook    UpdateHook
+	preUpdateHook UpdateHook
+	commitHook    CommitHook
+	rollbackHook  RollbackHook
+	authorizer    Authorizer
+
+	// statementCacheSize is the per-connection prepared-statement cache
+	// capacity every Connect applies; see WithStatementCacheSize.
+	statementCacheSize int
+
+	// retryPolicy governs how ExecContext, QueryContext, and RunInTx on
+	// every conn this Connector opens retry busy/locked/conflict errors;
+	// see WithMaxRetries, WithRetryBackoff, and WithRetryableErrors.
+	retryPolicy *retryPolicy
+
+	dbOnce sync.Once
+	db     *sql.DB
+
+	// timeFormat and timeLocation control how every conn this Connector
+	// opens binds time.Time arguments and decodes DATE/DATETIME/TIMESTAMP
+	// columns; see WithTimeFormat and WithTimeLocation.
+	timeFormat   TimeFormat
+	timeLocation *time.Location
+}
+
+func newConnector(nativeDbPtr C.libsql_database_t) *Connector {
+	c := &Connector{
+		nativeDbPtr:        nativeDbPtr,
+		statementCacheSize: defaultStatementCacheSize,
+		retryPolicy:        defaultRetryPolicy(),
+		timeFormat:         TimeFormatISO8601,
+		timeLocation:       time.UTC,
+	}
+	c.frameCond = sync.NewCond(&c.statsMu)
+	return c
 }
 
+// isRemoteOnly reports whether this Connector was opened against a remote
+// database with no local (embedded or embedded-replica) connection, in which
+// case native SQLite extension points such as user-defined functions cannot
+// be installed.
+func (c *Connector) isRemoteOnly() bool {
+	return c.remote
+}
+
+// Sync performs a single sync against the primary. It waits for any write
+// transaction currently open on a conn this Connector opened to commit or
+// roll back first, and holds off any that try to begin while it runs; see
+// writeTxLock.
 func (c *Connector) Sync() error {
-	return libsqlSync(c.nativeDbPtr)
+	c.writeTxLock.Lock()
+	defer c.writeTxLock.Unlock()
+	return retryWithBackoff(context.Background(), c.retryPolicy, c.syncOnce)
+}
+
+// syncOnce performs a single sync against the primary, reporting Start and
+// Success/Error events to syncHook (if set), updating stats, and waking any
+// WaitForFrame callers once the new frame number is visible.
+func (c *Connector) syncOnce() error {
+	c.statsMu.Lock()
+	frameNoBefore := c.stats.LastFrameNo
+	c.statsMu.Unlock()
+
+	if c.syncHook != nil {
+		c.syncHook(SyncEvent{Phase: SyncPhaseStart, FrameNoBefore: frameNoBefore})
+	}
+
+	start := time.Now()
+	frameNoAfter, framesApplied, err := libsqlSyncWithFrameNo(c.nativeDbPtr)
+	duration := time.Since(start)
+
+	event := SyncEvent{
+		FrameNoBefore: frameNoBefore,
+		FrameNoAfter:  frameNoAfter,
+		FramesApplied: framesApplied,
+		Duration:      duration,
+		Err:           err,
+	}
+
+	c.statsMu.Lock()
+	c.stats.SyncCount++
+	if err != nil {
+		c.stats.ErrorCount++
+		event.Phase = SyncPhaseError
+	} else {
+		c.stats.FramesApplied += framesApplied
+		c.stats.LastFrameNo = frameNoAfter
+		c.stats.LastSyncAt = start.Add(duration)
+		event.Phase = SyncPhaseSuccess
+	}
+	c.frameCond.Broadcast()
+	c.statsMu.Unlock()
+
+	if c.syncHook != nil {
+		c.syncHook(event)
+	}
+	if event.Phase == SyncPhaseSuccess {
+		c.publishSyncEvent(event)
+	}
+	return err
+}
+
+// TriggerSync immediately syncs this Connector's embedded replica against
+// its primary, coalescing with any sync already in flight -- whether
+// started by this call, a concurrent TriggerSync, or the periodic sync
+// goroutine -- rather than starting a redundant second one: every caller in
+// flight when a sync finishes observes that same sync's result. ctx only
+// bounds how long this call waits to observe the result of a sync already
+// in progress; once a sync has actually started against the primary it
+// runs to completion regardless of ctx. TriggerSync requires a Connector
+// opened with a non-zero WithSyncInterval.
+func (c *Connector) TriggerSync(ctx context.Context) error {
+	if c.syncManager == nil {
+		return fmt.Errorf("libsql: TriggerSync requires a Connector opened with WithSyncInterval")
+	}
+	return c.syncManager.syncNow(ctx)
+}
+
+// Stats returns a snapshot of this Connector's cumulative replication
+// counters. It is safe to call concurrently with syncing.
+func (c *Connector) Stats() SyncStats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	return c.stats
+}
+
+// WaitForFrame blocks until this Connector's embedded replica has applied
+// at least frameNo frames from its primary, or ctx is done. It lets a
+// process that did not perform a write itself implement read-your-writes:
+// the writer reads the frame number its sync landed on (Connector.Stats
+// after its own Sync), hands that number to a reader on a different
+// process, and the reader calls WaitForFrame before querying.
+func (c *Connector) WaitForFrame(ctx context.Context, frameNo uint64) error {
+	done := make(chan struct{})
+	reached := false
+	go func() {
+		defer close(done)
+		c.statsMu.Lock()
+		defer c.statsMu.Unlock()
+		for c.stats.LastFrameNo < frameNo && ctx.Err() == nil {
+			c.frameCond.Wait()
+		}
+		reached = c.stats.LastFrameNo >= frameNo
+	}()
+	select {
+	case <-done:
+		if !reached {
+			return ctx.Err()
+		}
+		return nil
+	case <-ctx.Done():
+		// Wake the waiting goroutine so it re-checks and exits once the
+		// next sync (or this broadcast) lets it observe ctx.Done; it is
+		// not joined before we return.
+		c.statsMu.Lock()
+		c.frameCond.Broadcast()
+		c.statsMu.Unlock()
+		return ctx.Err()
+	}
 }
 
 func (c *Connector) Close() error {
-	if c.closeCh != nil {
-		c.closeCh <- struct{}{}
-		<-c.closeAckCh
-		c.closeCh = nil
-		c.closeAckCh = nil
+	if c.syncManager != nil {
+		c.syncManager.close()
+		c.syncManager = nil
+	}
+	c.subscribersMu.Lock()
+	for _, sub := range c.subscribers {
+		close(sub.done)
 	}
+	c.subscribers = nil
+	c.subscribersMu.Unlock()
 	if c.nativeDbPtr != nil {
 		C.libsql_close(c.nativeDbPtr)
 	}
@@ -248,26 +833,73 @@ func (c *Connector) Close() error {
 	return nil
 }
 
+// Connect opens a new native connection off this Connector's database
+// handle. libsql_connect has no cancellation hook of its own, so a done ctx
+// aborts the wait on the Go side only: the native call is left to finish in
+// the background and its result (a connection nobody will ever use) is
+// closed once it arrives.
 func (c *Connector) Connect(ctx context.Context) (sqldriver.Conn, error) {
-	nativeConnPtr, err := libsqlConnect(c.nativeDbPtr)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	nativeConnPtr, err := retryConnect(ctx, c.retryPolicy, c.nativeDbPtr)
+	if err != nil {
+		return nil, err
+	}
+	funcHandles, err := c.installFunctions(nativeConnPtr)
+	if err != nil {
+		C.libsql_disconnect(nativeConnPtr)
+		return nil, err
+	}
+	collHandles, err := c.installCollations(nativeConnPtr)
 	if err != nil {
+		releaseHandles(funcHandles)
+		C.libsql_disconnect(nativeConnPtr)
 		return nil, err
 	}
-	return &conn{nativePtr: nativeConnPtr}, nil
+	hookHandles := c.installHooks(nativeConnPtr)
+	handles := append(funcHandles, collHandles...)
+	handles = append(handles, hookHandles...)
+	newConn := &conn{nativePtr: nativeConnPtr, remote: c.remote, primaryUrl: c.primaryUrl, stmtCache: newStmtCache(c.statementCacheSize), retryPolicy: c.retryPolicy, timeFormat: c.timeFormat, timeLocation: c.timeLocation, writeTxLock: &c.writeTxLock, handles: handles}
+	if c.connParams != nil {
+		newConn.txLock = c.connParams.txLock
+		for _, pragma := range c.connParams.pragmas() {
+			if _, err := newConn.executeNoArgs(ctx, pragma, true); err != nil {
+				releaseHandles(handles)
+				C.libsql_disconnect(nativeConnPtr)
+				return nil, err
+			}
+		}
+	}
+	return newConn, nil
 }
 
 func (c *Connector) Driver() sqldriver.Driver {
 	return driver{}
 }
 
+// Error is returned for any failure reported by the native libsql/SQLite
+// layer. Code carries the raw status code libsql_* functions return (the
+// same values as SQLite's own result codes, e.g. 5 for SQLITE_BUSY, 6 for
+// SQLITE_LOCKED), so callers can classify a failure with errors.As instead
+// of pattern-matching Error.Error()'s text.
+type Error struct {
+	msg  string
+	Code int
+}
+
+func (e *Error) Error() string {
+	return e.msg
+}
+
 func libsqlError(message string, statusCode C.int, errMsg *C.char) error {
 	code := int(statusCode)
 	if errMsg != nil {
 		msg := C.GoString(errMsg)
 		C.libsql_free_string(errMsg)
-		return fmt.Errorf("%s\nerror code = %d: %v", message, code, msg)
+		return &Error{msg: fmt.Sprintf("%s\nerror code = %d: %v", message, code, msg), Code: code}
 	} else {
-		return fmt.Errorf("%s\nerror code = %d", message, code)
+		return &Error{msg: fmt.Sprintf("%s\nerror code = %d", message, code), Code: code}
 	}
 }
 
@@ -326,6 +958,58 @@ func libsqlOpenWithSync(dbPath, primaryUrl, authToken string, readYourWrites boo
 	return db, nil
 }
 
+// libsqlOpenWithSyncTLS behaves like libsqlOpenWithSync, additionally
+// configuring the TLS behavior of the sync HTTP client and any Hrana channel
+// opened against primaryUrl. tlsConfig may be nil, in which case only
+// sslMode is applied over the platform's default trust store.
+func libsqlOpenWithSyncTLS(dbPath, primaryUrl, authToken string, readYourWrites bool, encryptionKey string, tlsConfig *tls.Config, sslMode string) (C.libsql_database_t, error) {
+	if tlsConfig == nil && sslMode == "" {
+		return libsqlOpenWithSync(dbPath, primaryUrl, authToken, readYourWrites, encryptionKey)
+	}
+
+	clientCertPEM, clientKeyPEM, err := clientCertificateToPEM(tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode TLS client certificate: %w", err)
+	}
+
+	dbPathNativeString := C.CString(dbPath)
+	defer C.free(unsafe.Pointer(dbPathNativeString))
+	primaryUrlNativeString := C.CString(primaryUrl)
+	defer C.free(unsafe.Pointer(primaryUrlNativeString))
+	authTokenNativeString := C.CString(authToken)
+	defer C.free(unsafe.Pointer(authTokenNativeString))
+
+	var readYourWritesNative C.char = 0
+	if readYourWrites {
+		readYourWritesNative = 1
+	}
+	var encrytionKeyNativeString *C.char
+	if encryptionKey != "" {
+		encrytionKeyNativeString = C.CString(encryptionKey)
+		defer C.free(unsafe.Pointer(encrytionKeyNativeString))
+	}
+	var clientCertNativeString *C.char
+	if clientCertPEM != "" {
+		clientCertNativeString = C.CString(clientCertPEM)
+		defer C.free(unsafe.Pointer(clientCertNativeString))
+	}
+	var clientKeyNativeString *C.char
+	if clientKeyPEM != "" {
+		clientKeyNativeString = C.CString(clientKeyPEM)
+		defer C.free(unsafe.Pointer(clientKeyNativeString))
+	}
+	sslModeNativeString := C.CString(sslModeOrDefault(sslMode))
+	defer C.free(unsafe.Pointer(sslModeNativeString))
+
+	var db C.libsql_database_t
+	var errMsg *C.char
+	statusCode := C.libsql_open_sync_with_tls(dbPathNativeString, primaryUrlNativeString, authTokenNativeString, readYourWritesNative, encrytionKeyNativeString, sslModeNativeString, clientCertNativeString, clientKeyNativeString, &db, &errMsg)
+	if statusCode != 0 {
+		return nil, libsqlError(fmt.Sprintf("failed to open database %s %s", dbPath, primaryUrl), statusCode, errMsg)
+	}
+	return db, nil
+}
+
 func libsqlConnect(db C.libsql_database_t) (C.libsql_connection_t, error) {
 	var conn C.libsql_connection_t
 	var errMsg *C.char
@@ -338,6 +1022,39 @@ func libsqlConnect(db C.libsql_database_t) (C.libsql_connection_t, error) {
 
 type conn struct {
 	nativePtr C.libsql_connection_t
+	// txLock is "", "deferred", "immediate", or "exclusive", set from the
+	// DSN's _txlock parameter; it picks the locking mode BeginTx opens with.
+	txLock string
+	// remote mirrors the owning Connector's isRemoteOnly, for APIs (such as
+	// Backup) that only see a *conn via sql.Conn.Raw and have no Connector
+	// to ask.
+	remote bool
+	// primaryUrl mirrors the owning Connector's primaryUrl, for APIs (such
+	// as BulkInsert) that only see a *conn via sql.Conn.Raw and have no
+	// Connector to ask.
+	primaryUrl string
+	// stmtCache holds this connection's prepared native statements, keyed
+	// by SQL text; see WithStatementCacheSize.
+	stmtCache *stmtCache
+	// retryPolicy is copied from the owning Connector; see
+	// Connector.retryPolicy.
+	retryPolicy *retryPolicy
+	// timeFormat and timeLocation are copied from the owning Connector; see
+	// Connector.timeFormat and Connector.timeLocation.
+	timeFormat   TimeFormat
+	timeLocation *time.Location
+	// txDepth is 0 when no transaction is open on c, 1 once BeginTx has
+	// opened one, and incremented further by a nested BeginTx, which issues
+	// a SAVEPOINT instead of BEGIN; see BeginTx.
+	txDepth int
+	// writeTxLock is the owning Connector's writeTxLock; see BeginTx and
+	// Connector.Sync.
+	writeTxLock *sync.RWMutex
+	// handles holds every cgo.Handle installFunctions, installCollations,
+	// and installHooks created for this connection, released in Close so a
+	// long-running pooled *sql.DB that cycles connections doesn't leak one
+	// handle per registered function/hook/collation per connection forever.
+	handles []cgo.Handle
 }
 
 func (c *conn) Prepare(query string) (sqldriver.Stmt, error) {
@@ -349,6 +1066,10 @@ func (c *conn) Begin() (sqldriver.Tx, error) {
 }
 
 func (c *conn) Close() error {
+	if c.stmtCache != nil {
+		c.stmtCache.invalidateAll()
+	}
+	releaseHandles(c.handles)
 	C.libsql_disconnect(c.nativePtr)
 	return nil
 }
@@ -419,6 +1140,47 @@ func extractParameters(stmt string) (nameParams []string, positionalParamsCount
 	return nameParams, positionalParamsCount, nil
 }
 
+// namedParamOrdinals returns, for stmt, the 1-based bind index SQLite
+// assigns each named parameter (":name", "@name", or "$name") the first
+// time it appears: parameters are numbered in the order they first occur in
+// the statement, whether positional ("?") or named, and a named parameter
+// that recurs later in the same statement keeps its first index. bindArgs
+// uses this to resolve a driver.NamedValue with a Name set (from sql.Named)
+// to the correct bind index, since database/sql otherwise only supplies the
+// argument's position in the call's argument list, which need not match its
+// position in the statement text.
+func namedParamOrdinals(stmt string) (map[string]int, error) {
+	statementStream := antlr.NewInputStream(stmt)
+	lexer := sqliteparser.NewSQLiteLexer(statementStream)
+	allTokens := lexer.GetAllTokens()
+
+	ordinals := make(map[string]int)
+	next := 1
+	for _, token := range allTokens {
+		if token.GetTokenType() != sqliteparser.SQLiteLexerBIND_PARAMETER {
+			continue
+		}
+		parameter := token.GetText()
+		isPositional, err := isPositionalParameter(parameter)
+		if err != nil {
+			return nil, err
+		}
+		if isPositional {
+			next++
+			continue
+		}
+		name, err := removeParamPrefix(parameter)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := ordinals[name]; !ok {
+			ordinals[name] = next
+			next++
+		}
+	}
+	return ordinals, nil
+}
+
 func parseStatement(sql string) ([]string, []ParamsInfo, error) {
 	stmts, _ := sqliteparserutils.SplitStatement(sql)
 
@@ -433,7 +1195,15 @@ func parseStatement(sql string) ([]string, []ParamsInfo, error) {
 	return stmts, stmtsParams, nil
 }
 
+// PrepareContext parses query into a driver.Stmt; parsing is pure Go (see
+// parseStatement) and never blocks, so ctx only gets an early exit if it is
+// already done by the time this is called. stmt.Query/Exec thread the
+// context given to them on into conn.execute, where cancellation actually
+// interrupts the native call.
 func (c *conn) PrepareContext(ctx context.Context, query string) (sqldriver.Stmt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	stmts, paramInfos, err := parseStatement(query)
 	if err != nil {
 		return nil, err
@@ -445,24 +1215,117 @@ func (c *conn) PrepareContext(ctx context.Context, query string) (sqldriver.Stmt
 	if len(paramInfos[0].NamedParameters) == 0 {
 		numInput = paramInfos[0].PositionalParametersCount
 	}
-	return &stmt{c, query, numInput}, nil
+	var ordinals map[string]int
+	if len(paramInfos[0].NamedParameters) > 0 {
+		ordinals, err = namedParamOrdinals(query)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &stmt{conn: c, sql: query, numInput: numInput, paramOrdinals: ordinals}, nil
 }
 
+// BeginTx opens a transaction against c. opts.Isolation must be
+// sql.LevelDefault, sql.LevelSerializable, or sql.LevelReadCommitted.
+// LevelSerializable issues BEGIN IMMEDIATE so writer contention is reported
+// at BEGIN rather than at the transaction's first write, which pairs
+// naturally with the retry policy (see withRetry). LevelReadCommitted
+// issues BEGIN DEFERRED, matching SQLite's own default locking (a deferred
+// transaction only takes the locks its statements actually need, so two
+// deferred transactions can both read without blocking each other, same as
+// Postgres' READ COMMITTED). opts.ReadOnly also issues BEGIN DEFERRED and
+// additionally sets PRAGMA query_only=ON for the duration of the
+// transaction, restoring its prior value on Commit or Rollback.
+//
+// A BeginTx called while c already has a transaction open is treated as a
+// nested transaction: it issues SAVEPOINT sp_<depth> instead of BEGIN, and
+// the returned Tx's Commit/Rollback map to RELEASE/ROLLBACK TO, so libraries
+// that assume nested-transaction support (common in migration tools built
+// against Postgres or MySQL) work against libsql. opts.ReadOnly has no
+// effect on a nested transaction: SQLite savepoints have no read-only mode.
 func (c *conn) BeginTx(ctx context.Context, opts sqldriver.TxOptions) (sqldriver.Tx, error) {
-	if opts.ReadOnly {
-		return nil, fmt.Errorf("read only transactions are not supported")
-	}
-	if opts.Isolation != sqldriver.IsolationLevel(sql.LevelDefault) {
+	isolation := sql.IsolationLevel(opts.Isolation)
+	if isolation != sql.LevelDefault && isolation != sql.LevelSerializable && isolation != sql.LevelReadCommitted {
 		return nil, fmt.Errorf("isolation level %d is not supported", opts.Isolation)
 	}
-	_, err := c.ExecContext(ctx, "BEGIN", nil)
-	if err != nil {
+
+	if c.txDepth > 0 {
+		c.txDepth++
+		savepoint := fmt.Sprintf("sp_%d", c.txDepth)
+		if _, err := c.ExecContext(ctx, "SAVEPOINT "+savepoint, nil); err != nil {
+			c.txDepth--
+			return nil, err
+		}
+		return &tx{conn: c, savepoint: savepoint}, nil
+	}
+
+	var beginStmt string
+	switch {
+	case opts.ReadOnly, isolation == sql.LevelReadCommitted:
+		beginStmt = "BEGIN DEFERRED TRANSACTION"
+	case isolation == sql.LevelSerializable:
+		beginStmt = "BEGIN IMMEDIATE TRANSACTION"
+	case c.txLock != "":
+		beginStmt = "BEGIN " + strings.ToUpper(c.txLock) + " TRANSACTION"
+	default:
+		beginStmt = "BEGIN"
+	}
+	// A write transaction holds the owning Connector's writeTxLock RLocked
+	// for its whole lifetime, so a concurrent Sync waits for it to finish
+	// instead of applying replica frames underneath it; see
+	// Connector.Sync. A read-only transaction never writes, so it never
+	// conflicts with a sync and does not take the lock.
+	heldWriteLock := !opts.ReadOnly
+	if heldWriteLock {
+		c.writeTxLock.RLock()
+	}
+	if _, err := c.ExecContext(ctx, beginStmt, nil); err != nil {
+		if heldWriteLock {
+			c.writeTxLock.RUnlock()
+		}
 		return nil, err
 	}
-	return &tx{c}, nil
+	c.txDepth = 1
+
+	t := &tx{conn: c, heldWriteLock: heldWriteLock}
+	if opts.ReadOnly {
+		wasOn, err := c.queryOnly(ctx)
+		if err == nil {
+			_, err = c.ExecContext(ctx, "PRAGMA query_only=ON", nil)
+		}
+		if err != nil {
+			c.ExecContext(ctx, "ROLLBACK", nil)
+			c.txDepth = 0
+			return nil, err
+		}
+		t.restoreQueryOnly = &wasOn
+	}
+	return t, nil
+}
+
+// queryOnly reports the current value of PRAGMA query_only on c, so a
+// read-only BeginTx can restore it once the transaction ends.
+func (c *conn) queryOnly(ctx context.Context) (bool, error) {
+	rows, err := c.QueryContext(ctx, "PRAGMA query_only", nil)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	dest := make([]sqldriver.Value, 1)
+	if err := rows.Next(dest); err != nil {
+		return false, err
+	}
+	v, ok := dest[0].(int64)
+	if !ok {
+		return false, fmt.Errorf("unexpected PRAGMA query_only result type %T", dest[0])
+	}
+	return v != 0, nil
 }
 
-func (c *conn) executeNoArgs(query string, exec bool) (C.libsql_rows_t, error) {
+func (c *conn) executeNoArgs(ctx context.Context, query string, exec bool) (C.libsql_rows_t, error) {
+	stop := c.interruptOnDone(ctx)
+	defer stop()
+
 	queryCString := C.CString(query)
 	defer C.free(unsafe.Pointer(queryCString))
 
@@ -475,70 +1338,177 @@ func (c *conn) executeNoArgs(query string, exec bool) (C.libsql_rows_t, error) {
 		statusCode = C.libsql_query(c.nativePtr, queryCString, &rows, &errMsg)
 	}
 	if statusCode != 0 {
-		return nil, libsqlError(fmt.Sprint("failed to execute query ", query), statusCode, errMsg)
+		return nil, ctxErr(ctx, libsqlError(fmt.Sprint("failed to execute query ", query), statusCode, errMsg))
 	}
 	return rows, nil
 }
 
-func (c *conn) execute(query string, args []sqldriver.NamedValue, exec bool) (C.libsql_rows_t, error) {
-	if len(args) == 0 {
-		return c.executeNoArgs(query, exec)
+// execute runs query, either binding args against a prepared statement or,
+// if args is empty and the cache is bypassed, through the no-bind fast path.
+// When the connection's statement cache is active (see
+// WithStatementCacheSize) and ctx was not derived from
+// WithoutStatementCache, the native prepared statement is fetched from or
+// returned to that cache instead of being prepared and freed on every call.
+func (c *conn) execute(ctx context.Context, query string, args []sqldriver.NamedValue, exec bool) (C.libsql_rows_t, error) {
+	useCache := c.stmtCache != nil && !bypassStmtCache(ctx)
+	if len(args) == 0 && !useCache {
+		return c.executeNoArgs(ctx, query, exec)
 	}
-	queryCString := C.CString(query)
-	defer C.free(unsafe.Pointer(queryCString))
+
+	stop := c.interruptOnDone(ctx)
+	defer stop()
 
 	var stmt C.libsql_stmt_t
-	var errMsg *C.char
-	statusCode := C.libsql_prepare(c.nativePtr, queryCString, &stmt, &errMsg)
-	if statusCode != 0 {
-		return nil, libsqlError(fmt.Sprint("failed to prepare query ", query), statusCode, errMsg)
+	cacheHit := false
+	if useCache {
+		if cached, ok := c.stmtCache.get(query); ok {
+			stmt = cached
+			cacheHit = true
+		}
+	}
+	if !cacheHit {
+		queryCString := C.CString(query)
+		defer C.free(unsafe.Pointer(queryCString))
+		var errMsg *C.char
+		statusCode := C.libsql_prepare(c.nativePtr, queryCString, &stmt, &errMsg)
+		if statusCode != 0 {
+			return nil, ctxErr(ctx, libsqlError(fmt.Sprint("failed to prepare query ", query), statusCode, errMsg))
+		}
 	}
-	defer C.libsql_free_stmt(stmt)
+	defer func() {
+		if useCache {
+			c.stmtCache.put(query, stmt)
+		} else {
+			C.libsql_free_stmt(stmt)
+		}
+	}()
+
+	ordinals, err := namedArgOrdinals(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.bindArgs(ctx, stmt, args, ordinals); err != nil {
+		return nil, err
+	}
+	return runPreparedStmt(ctx, stmt, query, exec)
+}
 
+// namedArgOrdinals computes the named-parameter-to-bind-index map query
+// needs to bind args (see namedParamOrdinals), or returns nil without
+// parsing query at all if args has no named values, since the common case
+// (purely positional "?" arguments) never needs it.
+func namedArgOrdinals(query string, args []sqldriver.NamedValue) (map[string]int, error) {
+	hasNamed := false
+	for _, arg := range args {
+		if arg.Name != "" {
+			hasNamed = true
+			break
+		}
+	}
+	if !hasNamed {
+		return nil, nil
+	}
+	return namedParamOrdinals(query)
+}
+
+// bindArgs binds args onto stmtHandle, an already-prepared native statement.
+// It is shared by execute's SQL-text-keyed path and stmt's own-handle path
+// (see (*stmt).execStmt). An arg with Name set (bound via sql.Named) is
+// resolved through ordinals to the bind index SQLite actually assigned that
+// parameter (see namedParamOrdinals) rather than trusting arg.Ordinal, which
+// is only the argument's position in the caller's argument list and need
+// not match its position in the statement text. ordinals may be nil if args
+// contains no named values.
+func (c *conn) bindArgs(ctx context.Context, stmtHandle C.libsql_stmt_t, args []sqldriver.NamedValue, ordinals map[string]int) error {
 	for _, arg := range args {
 		var errMsg *C.char
 		var statusCode C.int
 		idx := arg.Ordinal
-		switch arg.Value.(type) {
+		if arg.Name != "" {
+			ord, ok := ordinals[arg.Name]
+			if !ok {
+				return fmt.Errorf("no parameter named %q in statement", arg.Name)
+			}
+			idx = ord
+		}
+		value := arg.Value
+		// A driver.Valuer (e.g. sql.NullString, sql.NullTime, or a custom
+		// type) normally never reaches here because database/sql's default
+		// NamedValueChecker already calls Value() before handing args to
+		// ExecContext/QueryContext. It is unwrapped again here so the same
+		// is true of a conn used directly (via sql.Conn.Raw, say), bypassing
+		// that conversion.
+		if valuer, ok := value.(sqldriver.Valuer); ok {
+			v, err := valuer.Value()
+			if err != nil {
+				return fmt.Errorf("failed to get driver.Value for argument no. %d: %w", idx, err)
+			}
+			value = v
+		}
+		switch v := value.(type) {
 		case int64:
-			statusCode = C.libsql_bind_int(stmt, C.int(idx), C.longlong(arg.Value.(int64)), &errMsg)
+			statusCode = C.libsql_bind_int(stmtHandle, C.int(idx), C.longlong(v), &errMsg)
+		case int:
+			statusCode = C.libsql_bind_int(stmtHandle, C.int(idx), C.longlong(v), &errMsg)
+		case int32:
+			statusCode = C.libsql_bind_int(stmtHandle, C.int(idx), C.longlong(v), &errMsg)
+		case uint64:
+			if v > math.MaxInt64 {
+				return fmt.Errorf("uint64 argument no. %d with value %d overflows int64", idx, v)
+			}
+			statusCode = C.libsql_bind_int(stmtHandle, C.int(idx), C.longlong(v), &errMsg)
 		case float64:
-			statusCode = C.libsql_bind_float(stmt, C.int(idx), C.double(arg.Value.(float64)), &errMsg)
+			statusCode = C.libsql_bind_float(stmtHandle, C.int(idx), C.double(v), &errMsg)
 		case []byte:
-			blob := arg.Value.([]byte)
-			nativeBlob := C.CBytes(blob)
-			statusCode = C.libsql_bind_blob(stmt, C.int(idx), (*C.uchar)(nativeBlob), C.int(len(blob)), &errMsg)
+			nativeBlob := C.CBytes(v)
+			statusCode = C.libsql_bind_blob(stmtHandle, C.int(idx), (*C.uchar)(nativeBlob), C.int(len(v)), &errMsg)
 			C.free(nativeBlob)
 		case string:
-			valueStr := C.CString(arg.Value.(string))
-			statusCode = C.libsql_bind_string(stmt, C.int(idx), valueStr, &errMsg)
+			valueStr := C.CString(v)
+			statusCode = C.libsql_bind_string(stmtHandle, C.int(idx), valueStr, &errMsg)
 			C.free(unsafe.Pointer(valueStr))
 		case nil:
-			statusCode = C.libsql_bind_null(stmt, C.int(idx), &errMsg)
+			statusCode = C.libsql_bind_null(stmtHandle, C.int(idx), &errMsg)
 		case bool:
 			var valueInt int
-			if arg.Value.(bool) {
+			if v {
 				valueInt = 1
 			} else {
 				valueInt = 0
 			}
-			statusCode = C.libsql_bind_int(stmt, C.int(idx), C.longlong(valueInt), &errMsg)
+			statusCode = C.libsql_bind_int(stmtHandle, C.int(idx), C.longlong(valueInt), &errMsg)
+		case time.Time:
+			switch formatted := formatTime(v, c.timeFormat).(type) {
+			case int64:
+				statusCode = C.libsql_bind_int(stmtHandle, C.int(idx), C.longlong(formatted), &errMsg)
+			case string:
+				valueStr := C.CString(formatted)
+				statusCode = C.libsql_bind_string(stmtHandle, C.int(idx), valueStr, &errMsg)
+				C.free(unsafe.Pointer(valueStr))
+			}
 		default:
-			return nil, fmt.Errorf("unsupported type %T", arg.Value)
+			return fmt.Errorf("unsupported type %T", value)
 		}
 		if statusCode != 0 {
-			return nil, libsqlError(fmt.Sprintf("failed to bind argument no. %d with value %v and type %T", idx, arg.Value, arg.Value), statusCode, errMsg)
+			return ctxErr(ctx, libsqlError(fmt.Sprintf("failed to bind argument no. %d with value %v and type %T", idx, value, value), statusCode, errMsg))
 		}
 	}
+	return nil
+}
 
+// runPreparedStmt executes or queries stmtHandle, which must already have
+// its arguments bound (see bindArgs).
+func runPreparedStmt(ctx context.Context, stmtHandle C.libsql_stmt_t, query string, exec bool) (C.libsql_rows_t, error) {
 	var rows C.libsql_rows_t
+	var errMsg *C.char
+	var statusCode C.int
 	if exec {
-		statusCode = C.libsql_execute_stmt(stmt, &errMsg)
+		statusCode = C.libsql_execute_stmt(stmtHandle, &errMsg)
 	} else {
-		statusCode = C.libsql_query_stmt(stmt, &rows, &errMsg)
+		statusCode = C.libsql_query_stmt(stmtHandle, &rows, &errMsg)
 	}
 	if statusCode != 0 {
-		return nil, libsqlError(fmt.Sprint("failed to execute query ", query), statusCode, errMsg)
+		return nil, ctxErr(ctx, libsqlError(fmt.Sprint("failed to execute query ", query), statusCode, errMsg))
 	}
 	return rows, nil
 }
@@ -557,7 +1527,9 @@ func (r execResult) RowsAffected() (int64, error) {
 }
 
 func (c *conn) ExecContext(ctx context.Context, query string, args []sqldriver.NamedValue) (sqldriver.Result, error) {
-	rows, err := c.execute(query, args, true)
+	rows, err := c.retryingOp(ctx, func() (C.libsql_rows_t, error) {
+		return c.execute(ctx, query, args, true)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -566,16 +1538,35 @@ func (c *conn) ExecContext(ctx context.Context, query string, args []sqldriver.N
 	if rows != nil {
 		C.libsql_free_rows(rows)
 	}
+	if c.stmtCache != nil && looksLikeDDL(query) {
+		c.stmtCache.invalidateAll()
+	}
 	return execResult{id, changes}, nil
 }
 
+// stmt is a prepared statement returned by PrepareContext. Unlike the
+// SQL-text-keyed cache conn.execute consults for ad hoc queries (see
+// stmtCache), a stmt owns a single native handle for its whole lifetime:
+// prepared on first use, reset and rebound on every later use, and freed
+// once by Close.
 type stmt struct {
 	conn     *conn
 	sql      string
 	numInput int
+	// paramOrdinals maps each named parameter (":name", "@name", "$name") in
+	// sql to its bind index, computed once in PrepareContext; see
+	// namedParamOrdinals and bindArgs.
+	paramOrdinals map[string]int
+
+	native   C.libsql_stmt_t
+	prepared bool
 }
 
 func (s *stmt) Close() error {
+	if s.prepared {
+		C.libsql_free_stmt(s.native)
+		s.prepared = false
+	}
 	return nil
 }
 
@@ -583,6 +1574,49 @@ func (s *stmt) NumInput() int {
 	return s.numInput
 }
 
+// ensurePrepared makes s.native ready to bind arguments against: resetting
+// it if an earlier Exec/Query already prepared it, or preparing it fresh
+// otherwise. A statement that fails to reset (for example because the
+// schema it was prepared against has since changed) is dropped and prepared
+// again from scratch rather than returned as an error.
+func (s *stmt) ensurePrepared(ctx context.Context) error {
+	if s.prepared {
+		var errMsg *C.char
+		if statusCode := C.libsql_reset_stmt(s.native, &errMsg); statusCode == 0 {
+			return nil
+		}
+		C.libsql_free_stmt(s.native)
+		s.prepared = false
+	}
+	queryCString := C.CString(s.sql)
+	defer C.free(unsafe.Pointer(queryCString))
+	var native C.libsql_stmt_t
+	var errMsg *C.char
+	statusCode := C.libsql_prepare(s.conn.nativePtr, queryCString, &native, &errMsg)
+	if statusCode != 0 {
+		return ctxErr(ctx, libsqlError(fmt.Sprint("failed to prepare query ", s.sql), statusCode, errMsg))
+	}
+	s.native = native
+	s.prepared = true
+	return nil
+}
+
+// execStmt binds args onto s's own native handle and runs it, preparing or
+// resetting that handle as needed. Unlike conn.execute, the handle is never
+// returned to or freed via the connection's stmtCache: it persists on s
+// until Close.
+func (s *stmt) execStmt(ctx context.Context, args []sqldriver.NamedValue, exec bool) (C.libsql_rows_t, error) {
+	stop := s.conn.interruptOnDone(ctx)
+	defer stop()
+	if err := s.ensurePrepared(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.conn.bindArgs(ctx, s.native, args, s.paramOrdinals); err != nil {
+		return nil, err
+	}
+	return runPreparedStmt(ctx, s.native, s.sql, exec)
+}
+
 func convertToNamed(args []sqldriver.Value) []sqldriver.NamedValue {
 	if len(args) == 0 {
 		return nil
@@ -603,24 +1637,100 @@ func (s *stmt) Query(args []sqldriver.Value) (sqldriver.Rows, error) {
 }
 
 func (s *stmt) ExecContext(ctx context.Context, args []sqldriver.NamedValue) (sqldriver.Result, error) {
-	return s.conn.ExecContext(ctx, s.sql, args)
+	rows, err := s.conn.retryingOp(ctx, func() (C.libsql_rows_t, error) {
+		return s.execStmt(ctx, args, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+	id := int64(C.libsql_last_insert_rowid(s.conn.nativePtr))
+	changes := int64(C.libsql_changes(s.conn.nativePtr))
+	if rows != nil {
+		C.libsql_free_rows(rows)
+	}
+	if s.conn.stmtCache != nil && looksLikeDDL(s.sql) {
+		s.conn.stmtCache.invalidateAll()
+	}
+	return execResult{id, changes}, nil
 }
 
 func (s *stmt) QueryContext(ctx context.Context, args []sqldriver.NamedValue) (sqldriver.Rows, error) {
-	return s.conn.QueryContext(ctx, s.sql, args)
+	rowsNativePtr, err := s.conn.retryingOp(ctx, func() (C.libsql_rows_t, error) {
+		return s.execStmt(ctx, args, false)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newRows(rowsNativePtr, s.conn.timeLocation)
 }
 
+// tx is returned by conn.BeginTx: a top-level transaction closed with
+// COMMIT/ROLLBACK, or, when savepoint is set, a nested transaction closed
+// with RELEASE/ROLLBACK TO.
 type tx struct {
-	conn *conn
+	conn      *conn
+	savepoint string
+	// restoreQueryOnly holds the value of PRAGMA query_only from before a
+	// top-level read-only BeginTx set it to ON, to be restored on
+	// Commit/Rollback; nil for a transaction that did not touch it.
+	restoreQueryOnly *bool
+	// heldWriteLock records whether BeginTx RLocked conn.writeTxLock for
+	// this transaction (true for a top-level, non-read-only transaction);
+	// Commit and Rollback RUnlock it exactly when this is true.
+	heldWriteLock bool
+}
+
+// restoreQueryOnlyPragma returns the PRAGMA statement that restores
+// PRAGMA query_only to the value BeginTx observed before turning it on.
+func (t tx) restoreQueryOnlyPragma() string {
+	if *t.restoreQueryOnly {
+		return "PRAGMA query_only=ON"
+	}
+	return "PRAGMA query_only=OFF"
+}
+
+// releaseWriteLock RUnlocks t.conn.writeTxLock if BeginTx locked it for t;
+// see BeginTx and Connector.Sync.
+func (t tx) releaseWriteLock() {
+	if t.heldWriteLock {
+		t.conn.writeTxLock.RUnlock()
+	}
 }
 
 func (t tx) Commit() error {
+	defer t.releaseWriteLock()
+	if t.savepoint != "" {
+		_, err := t.conn.ExecContext(context.Background(), "RELEASE "+t.savepoint, nil)
+		t.conn.txDepth--
+		return err
+	}
+	if t.restoreQueryOnly != nil {
+		if _, err := t.conn.ExecContext(context.Background(), t.restoreQueryOnlyPragma(), nil); err != nil {
+			t.conn.txDepth = 0
+			return err
+		}
+	}
 	_, err := t.conn.ExecContext(context.Background(), "COMMIT", nil)
+	t.conn.txDepth = 0
 	return err
 }
 
 func (t tx) Rollback() error {
+	defer t.releaseWriteLock()
+	if t.savepoint != "" {
+		if _, err := t.conn.ExecContext(context.Background(), "ROLLBACK TO "+t.savepoint, nil); err != nil {
+			t.conn.txDepth--
+			return err
+		}
+		_, err := t.conn.ExecContext(context.Background(), "RELEASE "+t.savepoint, nil)
+		t.conn.txDepth--
+		return err
+	}
 	_, err := t.conn.ExecContext(context.Background(), "ROLLBACK", nil)
+	if t.restoreQueryOnly != nil {
+		t.conn.ExecContext(context.Background(), t.restoreQueryOnlyPragma(), nil)
+	}
+	t.conn.txDepth = 0
 	return err
 }
 
@@ -632,12 +1742,13 @@ const (
 	TYPE_NULL
 )
 
-func newRows(nativePtr C.libsql_rows_t) (*rows, error) {
+func newRows(nativePtr C.libsql_rows_t, timeLocation *time.Location) (*rows, error) {
 	if nativePtr == nil {
-		return &rows{nil, nil}, nil
+		return &rows{nativePtr: nil, timeLocation: timeLocation}, nil
 	}
 	columnCount := int(C.libsql_column_count(nativePtr))
 	columns := make([]string, columnCount)
+	decltypes := make([]string, columnCount)
 	for i := 0; i < columnCount; i++ {
 		var ptr *C.char
 		var errMsg *C.char
@@ -647,13 +1758,40 @@ func newRows(nativePtr C.libsql_rows_t) (*rows, error) {
 		}
 		columns[i] = C.GoString(ptr)
 		C.libsql_free_string(ptr)
+
+		var decltypePtr *C.char
+		statusCode = C.libsql_column_decltype(nativePtr, C.int(i), &decltypePtr, &errMsg)
+		if statusCode != 0 {
+			return nil, libsqlError(fmt.Sprint("failed to get column decltype for index ", i), statusCode, errMsg)
+		}
+		if decltypePtr != nil {
+			decltypes[i] = C.GoString(decltypePtr)
+			C.libsql_free_string(decltypePtr)
+		}
 	}
-	return &rows{nativePtr, columns}, nil
+	return &rows{nativePtr: nativePtr, columnNames: columns, columnDecltypes: decltypes, timeLocation: timeLocation}, nil
 }
 
 type rows struct {
 	nativePtr   C.libsql_rows_t
 	columnNames []string
+	// columnDecltypes holds libsql_column_decltype's result for each column,
+	// or "" for a column with no declared type (e.g. an expression). Next
+	// consults it via looksLikeTimeDecltype to decide whether a TEXT value
+	// should be parsed as time.Time, and the RowsColumnType* methods in
+	// columntype.go derive DatabaseTypeName/ScanType/Length/PrecisionScale
+	// from it.
+	columnDecltypes []string
+	timeLocation    *time.Location
+}
+
+// declType returns this rows' decltype for column i, or "" if i is out of
+// range or the column has none.
+func (r *rows) declType(i int) string {
+	if i < 0 || i >= len(r.columnDecltypes) {
+		return ""
+	}
+	return r.columnDecltypes[i]
 }
 
 func (r *rows) Columns() []string {
@@ -705,6 +1843,10 @@ func (r *rows) Next(dest []sqldriver.Value) error {
 			if statusCode != 0 {
 				return libsqlError(fmt.Sprint("failed to get integer for column ", i), statusCode, errMsg)
 			}
+			if looksLikeTimeDecltype(r.declType(i)) {
+				dest[i] = time.Unix(int64(value), 0).In(r.timeLocation)
+				break
+			}
 			dest[i] = int64(value)
 		case TYPE_FLOAT:
 			var value C.double
@@ -732,20 +1874,10 @@ func (r *rows) Next(dest []sqldriver.Value) error {
 			}
 			str := C.GoString(ptr)
 			C.libsql_free_string(ptr)
-			for _, format := range []string{
-				"2006-01-02 15:04:05.999999999-07:00",
-				"2006-01-02T15:04:05.999999999-07:00",
-				"2006-01-02 15:04:05.999999999",
-				"2006-01-02T15:04:05.999999999",
-				"2006-01-02 15:04:05",
-				"2006-01-02T15:04:05",
-				"2006-01-02 15:04",
-				"2006-01-02T15:04",
-				"2006-01-02",
-			} {
-				if t, err := time.ParseInLocation(format, str, time.UTC); err == nil {
+			if looksLikeTimeDecltype(r.declType(i)) {
+				if t, err := parseSQLiteTime(str, r.timeLocation); err == nil {
 					dest[i] = t
-					return nil
+					break
 				}
 			}
 			dest[i] = str
@@ -755,9 +1887,11 @@ func (r *rows) Next(dest []sqldriver.Value) error {
 }
 
 func (c *conn) QueryContext(ctx context.Context, query string, args []sqldriver.NamedValue) (sqldriver.Rows, error) {
-	rowsNativePtr, err := c.execute(query, args, false)
+	rowsNativePtr, err := c.retryingOp(ctx, func() (C.libsql_rows_t, error) {
+		return c.execute(ctx, query, args, false)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return newRows(rowsNativePtr)
+	return newRows(rowsNativePtr, c.timeLocation)
 }
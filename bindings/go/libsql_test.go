@@ -3,17 +3,27 @@ package libsql
 import (
 	"bytes"
 	"context"
+	"crypto/x509"
 	"database/sql"
+	sqldriver "database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"gotest.tools/assert"
 	"io"
+	"math"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"reflect"
+	"regexp"
 	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -473,6 +483,93 @@ func TestAutoSync(t *testing.T) {
 	})
 }
 
+func TestAutoSyncHook(t *testing.T) {
+	syncInterval := 1 * time.Second
+	var mu sync.Mutex
+	var events []SyncEvent
+	testSync(t, func(dbPath, primaryUrl, authToken string) *Connector {
+		options := []Option{
+			WithReadYourWrites(false),
+			WithSyncInterval(syncInterval),
+			WithSyncHook(func(e SyncEvent) {
+				mu.Lock()
+				defer mu.Unlock()
+				events = append(events, e)
+			}),
+		}
+		if authToken != "" {
+			options = append(options, WithAuthToken(authToken))
+		}
+		connector, err := NewEmbeddedReplicaConnector(dbPath, primaryUrl, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return connector
+	}, func(_ *Connector) {
+		time.Sleep(2 * syncInterval)
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	var lastFrameNo uint64
+	sawSuccess := false
+	for _, e := range events {
+		if e.Phase != SyncPhaseSuccess {
+			continue
+		}
+		if e.FrameNoAfter < lastFrameNo {
+			t.Fatalf("frame number went backwards: %d then %d", lastFrameNo, e.FrameNoAfter)
+		}
+		lastFrameNo = e.FrameNoAfter
+		sawSuccess = true
+	}
+	if !sawSuccess {
+		t.Fatal("expected at least one successful sync event")
+	}
+}
+
+func TestSyncSubscribe(t *testing.T) {
+	var subscriber *Connector
+	testSync(t, func(dbPath, primaryUrl, authToken string) *Connector {
+		options := []Option{WithReadYourWrites(false)}
+		if authToken != "" {
+			options = append(options, WithAuthToken(authToken))
+		}
+		connector, err := NewEmbeddedReplicaConnector(dbPath, primaryUrl, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subscriber = connector
+		return connector
+	}, func(c *Connector) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		events, err := c.Subscribe(ctx, SubscribeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatal("events channel closed before delivering a sync event")
+			}
+			if e.Phase != SyncPhaseSuccess {
+				t.Fatalf("expected SyncPhaseSuccess, got %v", e.Phase)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a sync event")
+		}
+	})
+	if subscriber != nil {
+		if _, err := subscriber.Subscribe(context.Background(), SubscribeOptions{IncludeChanges: true}); err == nil {
+			t.Fatal("expected Subscribe with IncludeChanges to fail")
+		}
+	}
+}
+
 func TestSync(t *testing.T) {
 	testSync(t, func(dbPath, primaryUrl, authToken string) *Connector {
 		options := []Option{WithReadYourWrites(false)}
@@ -614,431 +711,1000 @@ func testExecAndQuery(db *Database) {
 	table.assertRowExists(19)
 }
 
-func TestReadYourWrites(tt *testing.T) {
-	t := T{tt}
-	primaryUrl := os.Getenv("LIBSQL_PRIMARY_URL")
-	if primaryUrl == "" {
-		t.Skip("LIBSQL_PRIMARY_URL is not set")
-		return
-	}
-	authToken := os.Getenv("LIBSQL_AUTH_TOKEN")
-	dir, err := os.MkdirTemp("", "libsql-*")
-	if err != nil {
-		t.Fatal(err)
-	}
-	dbPath := dir + "/test.db"
-	options := []Option{}
-	if authToken != "" {
-		options = append(options, WithAuthToken(authToken))
-	}
-	connector, err := NewEmbeddedReplicaConnector(dbPath, primaryUrl, options...)
-	t.FatalOnError(err)
-	database := sql.OpenDB(connector)
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	t.Cleanup(func() {
-		database.Close()
-		connector.Close()
-		cancel()
-		defer os.RemoveAll(dir)
-	})
-	db := &Database{database, connector, t, ctx}
-	table := db.createTable()
-	table.insertRows(0, 10)
-	table.insertRowsWithArgs(10, 10)
-	table.assertRowsCount(20)
-	table.assertRowDoesNotExist(20)
-	table.assertRowExists(0)
-	table.assertRowExists(19)
-}
-
-func TestPreparedStatements(t *testing.T) {
-	db := getRemoteDb(T{t})
-	testPreparedStatements(db)
-}
-
-func TestPreparedStatementsEmbedded(t *testing.T) {
+func TestRegisterScalarFunction(t *testing.T) {
 	db := getEmbeddedDb(T{t})
-	testPreparedStatements(db)
+	testRegisterScalarFunction(db)
 }
 
-func testPreparedStatements(db *Database) {
+func testRegisterScalarFunction(db *Database) {
 	if db == nil {
 		return
 	}
-	table := db.createTable()
-	stmt := table.prepareInsertStmt()
-	stmt.exec(1, "1")
-	db.t.FatalOnError(stmt.Close())
-	db.sync()
-	table.assertRowsCount(1)
-	table.assertRowExists(1)
-}
-
-func TestTransaction(t *testing.T) {
-	db := getRemoteDb(T{t})
-	testTransaction(db)
+	re := regexp.MustCompile(`^[0-9]+$`)
+	db.connector.MustRegisterDeterministicScalarFunction("is_digits", 1, func(ctx *FunctionContext, args []sqldriver.Value) (sqldriver.Value, error) {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("is_digits: expected a string argument")
+		}
+		if re.MatchString(s) {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	})
+	var matches, noMatches int64
+	db.t.FatalOnError(db.QueryRowContext(db.ctx, "SELECT is_digits('1234'), is_digits('12a4')").Scan(&matches, &noMatches))
+	if matches != 1 {
+		db.t.FatalWithMsg("expected is_digits('1234') to be 1")
+	}
+	if noMatches != 0 {
+		db.t.FatalWithMsg("expected is_digits('12a4') to be 0")
+	}
 }
 
-func TestTransactionEmbedded(t *testing.T) {
+// TestRegisterScalarFunctionEmptyBlob guards against a cgo callback handing
+// goValueToNative a []byte{} return value: indexing its first element
+// unconditionally would panic inside the callback (and crash the process,
+// not just fail the test), so an empty BLOB is a legitimate result a
+// user-defined function must be able to return.
+func TestRegisterScalarFunctionEmptyBlob(t *testing.T) {
 	db := getEmbeddedDb(T{t})
-	testTransaction(db)
-}
-
-func testTransaction(db *Database) {
 	if db == nil {
 		return
 	}
-	table := db.createTable()
-	tx := table.beginTx()
-	tx.insertRows(0, 10)
-	tx.insertRowsWithArgs(10, 10)
-	tx.assertRowsCount(20)
-	tx.assertRowDoesNotExist(20)
-	tx.assertRowExists(0)
-	tx.assertRowExists(19)
-	db.t.FatalOnError(tx.Commit())
-	db.sync()
-	table.assertRowsCount(20)
-	table.assertRowDoesNotExist(20)
-	table.assertRowExists(0)
-	table.assertRowExists(19)
+	db.connector.MustRegisterDeterministicScalarFunction("empty_blob", 0, func(ctx *FunctionContext, args []sqldriver.Value) (sqldriver.Value, error) {
+		return []byte{}, nil
+	})
+	var got []byte
+	db.t.FatalOnError(db.QueryRowContext(db.ctx, "SELECT empty_blob()").Scan(&got))
+	if len(got) != 0 {
+		db.t.FatalWithMsg(fmt.Sprintf("expected an empty blob, got %v", got))
+	}
 }
 
-func TestMultiLineStatement(t *testing.T) {
-	t.Skip("Make it work")
-	db := getRemoteDb(T{t})
+// TestRegisterScalarFunctionSurvivesConnectionCycling guards against the
+// cgo.Handles installFunctions creates being forgotten once a *conn closes: a
+// pooled *sql.DB that cycles its underlying connections (idle timeout, max
+// lifetime) must still have the registered function available on every new
+// connection it opens, not just the first one.
+func TestRegisterScalarFunctionSurvivesConnectionCycling(t *testing.T) {
+	db := getEmbeddedDb(T{t})
 	if db == nil {
 		return
 	}
-	db.exec("CREATE TABLE IF NOT EXISTS my_table (my_data TEXT); INSERT INTO my_table (my_data) VALUES ('hello');")
-	t.Cleanup(func() {
-		db.exec("DROP TABLE my_table")
+	db.connector.MustRegisterDeterministicScalarFunction("doubled", 1, func(ctx *FunctionContext, args []sqldriver.Value) (sqldriver.Value, error) {
+		v, ok := args[0].(int64)
+		if !ok {
+			return nil, fmt.Errorf("doubled: expected an integer argument")
+		}
+		return v * 2, nil
 	})
-	table := Table{"my_table", *db}
-	db.assertTable("my_table")
-	table.assertRowsCount(1)
+	db.SetMaxIdleConns(0)
+	for i := 0; i < 5; i++ {
+		var got int64
+		db.t.FatalOnError(db.QueryRowContext(db.ctx, "SELECT doubled(?)", int64(i)).Scan(&got))
+		if got != int64(i)*2 {
+			db.t.FatalWithMsg(fmt.Sprintf("expected doubled(%d) = %d, got %d", i, i*2, got))
+		}
+	}
 }
 
-func TestPreparedStatementInTransaction(t *testing.T) {
-	db := getRemoteDb(T{t})
-	testPreparedStatementInTransaction(db)
+// runningSum is an AggregateFunction/WindowFunction that sums its single
+// int64 argument, usable both with GROUP BY and OVER (...).
+type runningSum struct {
+	total int64
 }
 
-func TestPreparedStatementInTransactionEmbedded(t *testing.T) {
-	db := getEmbeddedDb(T{t})
-	testPreparedStatementInTransaction(db)
+func (s *runningSum) Step(ctx *FunctionContext, args []sqldriver.Value) error {
+	v, ok := args[0].(int64)
+	if !ok {
+		return fmt.Errorf("running_sum: expected an integer argument")
+	}
+	s.total += v
+	return nil
 }
 
-func testPreparedStatementInTransaction(db *Database) {
-	if db == nil {
-		return
+func (s *runningSum) Final(ctx *FunctionContext) (sqldriver.Value, error) {
+	return s.total, nil
+}
+
+func (s *runningSum) WindowInverse(ctx *FunctionContext, args []sqldriver.Value) error {
+	v, ok := args[0].(int64)
+	if !ok {
+		return fmt.Errorf("running_sum: expected an integer argument")
 	}
-	table := db.createTable()
-	tx := table.beginTx()
-	stmt := tx.prepareInsertStmt()
-	stmt.exec(1, "1")
-	db.t.FatalOnError(stmt.Close())
-	tx.assertRowsCount(1)
-	tx.assertRowExists(1)
-	db.t.FatalOnError(tx.Commit())
-	db.sync()
-	table.assertRowsCount(1)
-	table.assertRowExists(1)
+	s.total -= v
+	return nil
 }
 
-func TestPreparedStatementInTransactionRollback(t *testing.T) {
-	db := getRemoteDb(T{t})
-	testPreparedStatementInTransactionRollback(db)
+func (s *runningSum) WindowValue(ctx *FunctionContext) (sqldriver.Value, error) {
+	return s.total, nil
 }
 
-func TestPreparedStatementInTransactionRollbackEmbedded(t *testing.T) {
+func TestRegisterAggregateAndWindowFunction(t *testing.T) {
 	db := getEmbeddedDb(T{t})
-	testPreparedStatementInTransactionRollback(db)
+	testRegisterAggregateAndWindowFunction(db)
 }
 
-func testPreparedStatementInTransactionRollback(db *Database) {
+func testRegisterAggregateAndWindowFunction(db *Database) {
 	if db == nil {
 		return
 	}
+	err := db.connector.RegisterAggregateFunction("running_sum", 1, func() AggregateFunction {
+		return &runningSum{}
+	})
+	db.t.FatalOnError(err)
+
 	table := db.createTable()
-	tx := table.beginTx()
-	stmt := tx.prepareInsertStmt()
-	stmt.exec(1, "1")
-	db.t.FatalOnError(stmt.Close())
-	tx.assertRowsCount(1)
-	tx.assertRowExists(1)
-	db.t.FatalOnError(tx.Rollback())
+	table.insertRows(0, 5)
 	db.sync()
-	table.assertRowsCount(0)
-	table.assertRowDoesNotExist(1)
-}
 
-func TestCancelContext(t *testing.T) {
-	db := getRemoteDb(T{t})
-	testCancelContext(db)
+	var total int64
+	db.t.FatalOnError(db.QueryRowContext(db.ctx, "SELECT running_sum(b) FROM "+table.name).Scan(&total))
+	if total != 0+1+2+3+4 {
+		db.t.FatalWithMsg(fmt.Sprintf("expected running_sum to be 10, got %d", total))
+	}
+
+	rows := db.query("SELECT running_sum(b) OVER (ORDER BY a) FROM " + table.name)
+	defer rows.Close()
+	var sums []int64
+	for rows.Next() {
+		var sum int64
+		db.t.FatalOnError(rows.Scan(&sum))
+		sums = append(sums, sum)
+	}
+	assert.DeepEqual(db.t.T, sums, []int64{0, 1, 3, 6, 10})
 }
 
-func TestCancelContextEmbedded(t *testing.T) {
-	db := getEmbeddedDb(T{t})
-	testCancelContext(db)
+// runFunctionMemoryAndFileTests is runMemoryAndFileTests's counterpart for
+// tests that need the *Connector itself (to register functions on) rather
+// than just the *sql.DB it opens.
+func runFunctionMemoryAndFileTests(t *testing.T, test func(t *testing.T, connector *Connector)) {
+	t.Parallel()
+	t.Run("Memory", func(t *testing.T) {
+		t.Parallel()
+		runFunctionTest(t, ":memory:", test)
+	})
+	t.Run("File", func(t *testing.T) {
+		t.Parallel()
+		dir, err := os.MkdirTemp("", "libsql-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		runFunctionTest(t, "file:"+dir+"/test.db", test)
+	})
 }
 
-func testCancelContext(db *Database) {
-	if db == nil {
-		return
-	}
-	ctx, cancel := context.WithCancel(context.Background())
-	cancel()
-	_, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS test (id INTEGER PRIMARY KEY, name TEXT)")
-	if err == nil {
-		db.t.FatalWithMsg("should have failed")
-	}
-	if !errors.Is(err, context.Canceled) {
-		db.t.FatalWithMsg("should have failed with context.Canceled")
+func runFunctionTest(t *testing.T, dbAddress string, test func(t *testing.T, connector *Connector)) {
+	sqlConnector, err := (driver{}).OpenConnector(dbAddress)
+	if err != nil {
+		t.Fatal(err)
 	}
+	connector := sqlConnector.(*Connector)
+	defer connector.Close()
+	test(t, connector)
 }
 
-func TestCancelContextWithTransaction(t *testing.T) {
-	db := getRemoteDb(T{t})
-	testCancelContextWithTransaction(db)
-}
+func TestRegisterScalarFunctionMemoryAndFile(t *testing.T) {
+	runFunctionMemoryAndFileTests(t, func(t *testing.T, connector *Connector) {
+		if err := connector.RegisterScalarFunction("test_int64", 1, func(ctx *FunctionContext, args []sqldriver.Value) (sqldriver.Value, error) {
+			v, ok := args[0].(int64)
+			if !ok {
+				return nil, fmt.Errorf("test_int64: expected an integer argument")
+			}
+			return v * 2, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
 
-func TestCancelContextWithTransactionEmbedded(t *testing.T) {
-	db := getEmbeddedDb(T{t})
-	testCancelContextWithTransaction(db)
+		db := sql.OpenDB(connector)
+		defer db.Close()
+
+		var result int64
+		if err := db.QueryRow("SELECT test_int64(21)").Scan(&result); err != nil {
+			t.Fatal(err)
+		}
+		if result != 42 {
+			t.Fatalf("expected test_int64(21) to be 42, got %d", result)
+		}
+	})
 }
 
-func testCancelContextWithTransaction(db *Database) {
-	if db == nil {
-		return
-	}
-	table := db.createTable()
-	ctx, cancel := context.WithCancel(context.Background())
-	tx := table.beginTxWithContext(ctx)
-	tx.insertRows(0, 10)
-	tx.insertRowsWithArgs(10, 10)
-	tx.assertRowsCount(20)
-	tx.assertRowDoesNotExist(20)
-	tx.assertRowExists(0)
-	tx.assertRowExists(19)
-	// let's cancel the context before the commit
-	cancel()
-	err := tx.Commit()
-	if err == nil {
-		db.t.FatalWithMsg("should have failed")
-	}
-	if !errors.Is(err, context.Canceled) {
-		db.t.FatalWithMsg("should have failed with context.Canceled")
-	}
-	// rolling back the transaction should not result in any error
-	db.t.FatalOnError(tx.Rollback())
-}
+func TestRegisterAggregateAndWindowFunctionMemoryAndFile(t *testing.T) {
+	runFunctionMemoryAndFileTests(t, func(t *testing.T, connector *Connector) {
+		if err := connector.RegisterAggregateFunction("test_sum", 1, func() AggregateFunction {
+			return &runningSum{}
+		}); err != nil {
+			t.Fatal(err)
+		}
 
-func TestTransactionRollback(t *testing.T) {
-	db := getRemoteDb(T{t})
-	testTransactionRollback(db)
-}
+		db := sql.OpenDB(connector)
+		defer db.Close()
 
-func TestTransactionRollbackEmbedded(t *testing.T) {
-	db := getEmbeddedDb(T{t})
-	testTransactionRollback(db)
+		if _, err := db.Exec("CREATE TABLE nums(a INTEGER, b INTEGER)"); err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < 5; i++ {
+			if _, err := db.Exec("INSERT INTO nums(a, b) VALUES (?, ?)", i, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var total int64
+		if err := db.QueryRow("SELECT test_sum(b) FROM nums").Scan(&total); err != nil {
+			t.Fatal(err)
+		}
+		if total != 0+1+2+3+4 {
+			t.Fatalf("expected test_sum to be 10, got %d", total)
+		}
+
+		rows, err := db.Query("SELECT test_sum(b) OVER (ORDER BY a) FROM nums")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var sums []int64
+		for rows.Next() {
+			var sum int64
+			if err := rows.Scan(&sum); err != nil {
+				t.Fatal(err)
+			}
+			sums = append(sums, sum)
+		}
+		assert.DeepEqual(t, sums, []int64{0, 1, 3, 6, 10})
+	})
 }
 
-func testTransactionRollback(db *Database) {
-	if db == nil {
-		return
-	}
-	table := db.createTable()
-	tx := table.beginTx()
-	tx.insertRows(0, 10)
-	tx.insertRowsWithArgs(10, 10)
-	tx.assertRowsCount(20)
-	tx.assertRowDoesNotExist(20)
-	tx.assertRowExists(0)
-	tx.assertRowExists(19)
-	db.t.FatalOnError(tx.Rollback())
-	db.sync()
-	table.assertRowsCount(0)
+type capturedUpdate struct {
+	Op    UpdateOp
+	DB    string
+	Table string
+	RowID int64
 }
 
-func TestArguments(t *testing.T) {
-	db := getRemoteDb(T{t})
-	testArguments(db)
+func TestRegisterUpdateHookMemoryAndFile(t *testing.T) {
+	runFunctionMemoryAndFileTests(t, func(t *testing.T, connector *Connector) {
+		var mu sync.Mutex
+		var updates []capturedUpdate
+		if err := connector.RegisterUpdateHook(func(op UpdateOp, db, table string, rowID int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			updates = append(updates, capturedUpdate{op, db, table, rowID})
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		db := sql.OpenDB(connector)
+		defer db.Close()
+
+		if _, err := db.Exec("CREATE TABLE widgets(id INTEGER PRIMARY KEY, name TEXT)"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO widgets(id, name) VALUES (1, 'a')"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("UPDATE widgets SET name = 'b' WHERE id = 1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("DELETE FROM widgets WHERE id = 1"); err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		want := []capturedUpdate{
+			{OpInsert, "main", "widgets", 1},
+			{OpUpdate, "main", "widgets", 1},
+			{OpDelete, "main", "widgets", 1},
+		}
+		assert.DeepEqual(t, updates, want)
+	})
 }
 
-func TestArgumentsEmbedded(t *testing.T) {
-	db := getEmbeddedDb(T{t})
-	testArguments(db)
+func TestRegisterCommitHookVetoesTransactionMemoryAndFile(t *testing.T) {
+	runFunctionMemoryAndFileTests(t, func(t *testing.T, connector *Connector) {
+		veto := false
+		if err := connector.RegisterCommitHook(func() int {
+			if veto {
+				return 1
+			}
+			return 0
+		}); err != nil {
+			t.Fatal(err)
+		}
+		var rolledBack bool
+		if err := connector.RegisterRollbackHook(func() {
+			rolledBack = true
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		db := sql.OpenDB(connector)
+		defer db.Close()
+
+		if _, err := db.Exec("CREATE TABLE widgets(id INTEGER PRIMARY KEY)"); err != nil {
+			t.Fatal(err)
+		}
+
+		veto = true
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec("INSERT INTO widgets(id) VALUES (1)"); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err == nil {
+			t.Fatal("expected the commit hook's veto to turn Commit into an error")
+		}
+		if !rolledBack {
+			t.Fatal("expected the rollback hook to fire after the vetoed commit")
+		}
+
+		var count int
+		if err := db.QueryRow("SELECT count(*) FROM widgets").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Fatalf("expected the vetoed insert to be rolled back, got %d rows", count)
+		}
+	})
 }
 
-func testArguments(db *Database) {
-	if db == nil {
-		return
+func TestBackupFileToMemory(t *testing.T) {
+	dir, err := os.MkdirTemp("", "libsql-*")
+	if err != nil {
+		t.Fatal(err)
 	}
-	t := db.t
-	tableName := fmt.Sprintf("test_%d", time.Now().UnixNano())
-	_, err := db.Exec(fmt.Sprintf("CREATE TABLE %s (id INTEGER, name TEXT, gpa REAL, cv BLOB);", tableName))
+	defer os.RemoveAll(dir)
+
+	src, err := sql.Open("libsql", "file:"+dir+"/src.db")
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = db.Exec(fmt.Sprintf("INSERT INTO %s (id, name, gpa, cv) VALUES (?, ?, ?, randomblob(10));", tableName), 0, fmt.Sprint(0), 0.5)
+	defer src.Close()
+
+	if _, err := src.Exec("CREATE TABLE widgets(id INTEGER PRIMARY KEY, name TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	const rowCount = 50
+	for i := 0; i < rowCount; i++ {
+		if _, err := src.Exec("INSERT INTO widgets(id, name) VALUES (?, ?)", i, fmt.Sprintf("widget-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst, err := sql.Open("libsql", ":memory:")
 	if err != nil {
 		t.Fatal(err)
 	}
-	db.sync()
-	rows, err := db.QueryContext(context.Background(), "SELECT NULL, id, name, gpa, cv FROM "+tableName)
+	defer dst.Close()
+
+	var progressCalls int
+	handle, err := Backup(dst, src, WithBackupProgress(func(remaining, total int) {
+		progressCalls++
+	}))
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer rows.Close()
-	idx := 0
-	for rows.Next() {
-		if idx > 0 {
-			t.Fatal("idx should be <= ", 0)
-		}
-		var null any
-		var id int
-		var name string
-		var gpa float64
-		var cv []byte
-		if err := rows.Scan(&null, &id, &name, &gpa, &cv); err != nil {
+	defer handle.Close()
+
+	for i := 0; ; i++ {
+		// Interleave writes against src to prove the backup runs online.
+		if _, err := src.Exec("INSERT INTO widgets(id, name) VALUES (?, ?)", rowCount+i, "written-during-backup"); err != nil {
 			t.Fatal(err)
 		}
-		if null != nil {
-			t.Fatal("null should be nil")
-		}
-		if id != int(idx) {
-			t.Fatal("id should be ", idx, " got ", id)
-		}
-		if name != fmt.Sprint(idx) {
-			t.Fatal("name should be", idx)
-		}
-		if gpa != float64(idx)+0.5 {
-			t.Fatal("gpa should be", float64(idx)+0.5)
+		done, _, _, err := handle.Step(5)
+		if err != nil {
+			t.Fatal(err)
 		}
-		if len(cv) != 10 {
-			t.Fatal("cv should be 10 bytes")
+		if done {
+			break
 		}
-		idx++
 	}
-	if idx != 1 {
-		t.Fatal("idx should be 1 got ", idx)
+	if progressCalls == 0 {
+		t.Fatal("expected the progress callback to fire at least once")
 	}
-}
-
-func TestPing(t *testing.T) {
-	db := getRemoteDb(T{t})
-	testPing(db)
-}
 
-func TestPingEmbedded(t *testing.T) {
-	db := getEmbeddedDb(T{t})
-	testPing(db)
+	var count int
+	if err := dst.QueryRow("SELECT count(*) FROM widgets WHERE id < ?", rowCount).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != rowCount {
+		t.Fatalf("expected %d backed-up rows, got %d", rowCount, count)
+	}
 }
 
-func testPing(db *Database) {
-	if db == nil {
-		return
+func TestBackupRemoteNotSupported(t *testing.T) {
+	primaryUrl := os.Getenv("LIBSQL_PRIMARY_URL")
+	if primaryUrl == "" {
+		t.Skip("LIBSQL_PRIMARY_URL is not set")
 	}
-	// This ping should succeed because the database is up and running
-	db.t.FatalOnError(db.Ping())
+	authToken := os.Getenv("LIBSQL_AUTH_TOKEN")
+	src, err := sql.Open("libsql", primaryUrl+"?authToken="+authToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
 
-	db.t.Cleanup(func() {
-		db.Close()
+	dst, err := sql.Open("libsql", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
 
-		// This ping should return an error because the database is already closed
-		err := db.Ping()
-		if err == nil {
-			db.t.Fatal("db.Ping succeeded when it should have failed")
-		}
-	})
+	if _, err := Backup(dst, src); err == nil {
+		t.Fatal("expected Backup from a remote-only connection to fail")
+	}
 }
 
-func TestDataTypes(t *testing.T) {
+func TestBulkLoad(t *testing.T) {
 	db := getRemoteDb(T{t})
-	testDataTypes(db)
+	testBulkLoad(db)
 }
 
-func TestDataTypesEmbedded(t *testing.T) {
+func TestBulkLoadEmbedded(t *testing.T) {
 	db := getEmbeddedDb(T{t})
-	testDataTypes(db)
+	testBulkLoad(db)
 }
 
-func testDataTypes(db *Database) {
+func testBulkLoad(db *Database) {
 	if db == nil {
 		return
 	}
-	var (
-		text        string
-		nullText    sql.NullString
-		integer     sql.NullInt64
-		nullInteger sql.NullInt64
-		boolean     bool
-		float8      float64
-		nullFloat   sql.NullFloat64
-		bytea       []byte
-		Time        time.Time
-	)
-	t := db.t
-	db.t.FatalOnError(db.QueryRowContext(db.ctx, "SELECT 'foobar' as text, NULL as text,  NULL as integer, 42 as integer, 1 as boolean, X'000102' as bytea, 3.14 as float8, NULL as float8, '0001-01-01 01:00:00+00:00' as time;").Scan(&text, &nullText, &nullInteger, &integer, &boolean, &bytea, &float8, &nullFloat, &Time))
-	switch {
-	case text != "foobar":
-		t.Error("value mismatch - text")
-	case nullText.Valid:
-		t.Error("null text is valid")
-	case nullInteger.Valid:
-		t.Error("null integer is valid")
-	case !integer.Valid:
-		t.Error("integer is not valid")
-	case integer.Int64 != 42:
-		t.Error("value mismatch - integer")
-	case !boolean:
-		t.Error("value mismatch - boolean")
-	case float8 != 3.14:
-		t.Error("value mismatch - float8")
-	case !bytes.Equal(bytea, []byte{0, 1, 2}):
-		t.Error("value mismatch - bytea")
-	case nullFloat.Valid:
-		t.Error("null float is valid")
-	case !Time.Equal(time.Time{}.Add(time.Hour)):
-		t.Error("value mismatch - time")
+	table := db.createTable()
+
+	const rowCount = 100_000
+	ldr, err := db.connector.BeginLoad(db.ctx, table.name, []string{"a", "b"})
+	db.t.FatalOnError(err)
+	for i := 0; i < rowCount; i++ {
+		db.t.FatalOnError(ldr.Add(db.ctx, i, i*2))
+	}
+	rowsLoaded, err := ldr.Close(db.ctx)
+	db.t.FatalOnError(err)
+	if rowsLoaded != rowCount {
+		db.t.FatalWithMsg(fmt.Sprintf("expected %d rows loaded, got %d", rowCount, rowsLoaded))
 	}
-}
 
-func TestConcurrentOnSingleConnection(t *testing.T) {
-	db := getRemoteDb(T{t})
-	testConcurrentOnSingleConnection(db)
-}
+	db.sync()
+	table.assertRowsCount(rowCount)
+	table.assertRowExists(0)
+	table.assertRowExists(rowCount - 1)
 
-func TestConcurrentOnSingleConnectionEmbedded(t *testing.T) {
-	db := getEmbeddedDb(T{t})
-	testConcurrentOnSingleConnection(db)
+	var b int64
+	db.t.FatalOnError(db.QueryRowContext(db.ctx, "SELECT b FROM "+table.name+" WHERE a = ?", rowCount/2).Scan(&b))
+	if b != int64(rowCount/2)*2 {
+		db.t.FatalWithMsg(fmt.Sprintf("expected b = %d for a = %d, got %d", (rowCount/2)*2, rowCount/2, b))
+	}
 }
 
-func testConcurrentOnSingleConnection(db *Database) {
+func TestBulkInsert(t *testing.T) {
+	db := getRemoteDb(T{t})
 	if db == nil {
 		return
 	}
-	t1 := db.createTable()
-	t2 := db.createTable()
-	t3 := db.createTable()
-	t1.insertRowsInternal(1, 10, func(i int) sql.Result {
-		return t1.db.exec("INSERT INTO "+t1.name+" VALUES(?, ?)", i, i)
-	})
-	t2.insertRowsInternal(1, 10, func(i int) sql.Result {
-		return t2.db.exec("INSERT INTO "+t2.name+" VALUES(?, ?)", i, -1*i)
-	})
-	t3.insertRowsInternal(1, 10, func(i int) sql.Result {
-		return t3.db.exec("INSERT INTO "+t3.name+" VALUES(?, ?)", i, 0)
-	})
-	db.sync()
-	g, ctx := errgroup.WithContext(context.Background())
-	conn, err := db.Conn(context.Background())
+	table := db.createTable()
+
+	conn, err := db.Conn(db.ctx)
 	db.t.FatalOnError(err)
 	defer conn.Close()
-	worker := func(t Table, check func(int) error) func() error {
-		return func() error {
-			for i := 1; i < 100; i++ {
+
+	const rowCount = 1000
+	ldr, err := BulkInsert(db.ctx, conn, table.name, []string{"a", "b"}, WithMaxBatchBytes(4096))
+	db.t.FatalOnError(err)
+	for i := 0; i < rowCount; i++ {
+		db.t.FatalOnError(ldr.Add(db.ctx, i, i*2))
+	}
+	rowsLoaded, err := ldr.Close(db.ctx)
+	db.t.FatalOnError(err)
+	if rowsLoaded != rowCount {
+		t.Fatalf("expected %d rows loaded, got %d", rowCount, rowsLoaded)
+	}
+
+	table.assertRowsCount(rowCount)
+	table.assertRowExists(0)
+	table.assertRowExists(rowCount - 1)
+
+	// conn must still be usable: BulkInsert must not have closed it out
+	// from under the pool.
+	db.t.FatalOnError(conn.PingContext(db.ctx))
+}
+
+func TestBulkInsertRefusesEmbeddedReplica(t *testing.T) {
+	db := getEmbeddedDb(T{t})
+	if db == nil {
+		return
+	}
+	table := db.createTable()
+
+	conn, err := db.Conn(db.ctx)
+	db.t.FatalOnError(err)
+	defer conn.Close()
+
+	if _, err := BulkInsert(db.ctx, conn, table.name, []string{"a", "b"}); err == nil {
+		t.Fatal("expected BulkInsert against an embedded replica to fail")
+	}
+}
+
+// TestEmbeddedReplicaTLSRootCAMismatch verifies that, when the configured
+// root CAs don't cover the primary's certificate, the failure surfaces from
+// NewEmbeddedReplicaConnector itself (via the TLS preflight) rather than
+// silently at the first Sync.
+func TestEmbeddedReplicaTLSRootCAMismatch(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	dir, err := os.MkdirTemp("", "libsql-tls-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An empty pool can never validate server's self-signed certificate.
+	_, err = NewEmbeddedReplicaConnector(dir+"/test.db", server.URL, WithRootCAs(x509.NewCertPool()), WithSSLMode("verify-ca"))
+	if err == nil {
+		t.Fatal("expected NewEmbeddedReplicaConnector to fail with a root CA mismatch")
+	}
+}
+
+func TestReadYourWrites(tt *testing.T) {
+	t := T{tt}
+	primaryUrl := os.Getenv("LIBSQL_PRIMARY_URL")
+	if primaryUrl == "" {
+		t.Skip("LIBSQL_PRIMARY_URL is not set")
+		return
+	}
+	authToken := os.Getenv("LIBSQL_AUTH_TOKEN")
+	dir, err := os.MkdirTemp("", "libsql-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := dir + "/test.db"
+	options := []Option{}
+	if authToken != "" {
+		options = append(options, WithAuthToken(authToken))
+	}
+	connector, err := NewEmbeddedReplicaConnector(dbPath, primaryUrl, options...)
+	t.FatalOnError(err)
+	database := sql.OpenDB(connector)
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	t.Cleanup(func() {
+		database.Close()
+		connector.Close()
+		cancel()
+		defer os.RemoveAll(dir)
+	})
+	db := &Database{database, connector, t, ctx}
+	table := db.createTable()
+	table.insertRows(0, 10)
+	table.insertRowsWithArgs(10, 10)
+	table.assertRowsCount(20)
+	table.assertRowDoesNotExist(20)
+	table.assertRowExists(0)
+	table.assertRowExists(19)
+}
+
+func TestPreparedStatements(t *testing.T) {
+	db := getRemoteDb(T{t})
+	testPreparedStatements(db)
+}
+
+func TestPreparedStatementsEmbedded(t *testing.T) {
+	db := getEmbeddedDb(T{t})
+	testPreparedStatements(db)
+}
+
+func testPreparedStatements(db *Database) {
+	if db == nil {
+		return
+	}
+	table := db.createTable()
+	stmt := table.prepareInsertStmt()
+	stmt.exec(1, "1")
+	db.t.FatalOnError(stmt.Close())
+	db.sync()
+	table.assertRowsCount(1)
+	table.assertRowExists(1)
+}
+
+func TestTransaction(t *testing.T) {
+	db := getRemoteDb(T{t})
+	testTransaction(db)
+}
+
+func TestTransactionEmbedded(t *testing.T) {
+	db := getEmbeddedDb(T{t})
+	testTransaction(db)
+}
+
+func testTransaction(db *Database) {
+	if db == nil {
+		return
+	}
+	table := db.createTable()
+	tx := table.beginTx()
+	tx.insertRows(0, 10)
+	tx.insertRowsWithArgs(10, 10)
+	tx.assertRowsCount(20)
+	tx.assertRowDoesNotExist(20)
+	tx.assertRowExists(0)
+	tx.assertRowExists(19)
+	db.t.FatalOnError(tx.Commit())
+	db.sync()
+	table.assertRowsCount(20)
+	table.assertRowDoesNotExist(20)
+	table.assertRowExists(0)
+	table.assertRowExists(19)
+}
+
+func TestMultiLineStatement(t *testing.T) {
+	t.Skip("Make it work")
+	db := getRemoteDb(T{t})
+	if db == nil {
+		return
+	}
+	db.exec("CREATE TABLE IF NOT EXISTS my_table (my_data TEXT); INSERT INTO my_table (my_data) VALUES ('hello');")
+	t.Cleanup(func() {
+		db.exec("DROP TABLE my_table")
+	})
+	table := Table{"my_table", *db}
+	db.assertTable("my_table")
+	table.assertRowsCount(1)
+}
+
+func TestPreparedStatementInTransaction(t *testing.T) {
+	db := getRemoteDb(T{t})
+	testPreparedStatementInTransaction(db)
+}
+
+func TestPreparedStatementInTransactionEmbedded(t *testing.T) {
+	db := getEmbeddedDb(T{t})
+	testPreparedStatementInTransaction(db)
+}
+
+func testPreparedStatementInTransaction(db *Database) {
+	if db == nil {
+		return
+	}
+	table := db.createTable()
+	tx := table.beginTx()
+	stmt := tx.prepareInsertStmt()
+	stmt.exec(1, "1")
+	db.t.FatalOnError(stmt.Close())
+	tx.assertRowsCount(1)
+	tx.assertRowExists(1)
+	db.t.FatalOnError(tx.Commit())
+	db.sync()
+	table.assertRowsCount(1)
+	table.assertRowExists(1)
+}
+
+func TestPreparedStatementInTransactionRollback(t *testing.T) {
+	db := getRemoteDb(T{t})
+	testPreparedStatementInTransactionRollback(db)
+}
+
+func TestPreparedStatementInTransactionRollbackEmbedded(t *testing.T) {
+	db := getEmbeddedDb(T{t})
+	testPreparedStatementInTransactionRollback(db)
+}
+
+func testPreparedStatementInTransactionRollback(db *Database) {
+	if db == nil {
+		return
+	}
+	table := db.createTable()
+	tx := table.beginTx()
+	stmt := tx.prepareInsertStmt()
+	stmt.exec(1, "1")
+	db.t.FatalOnError(stmt.Close())
+	tx.assertRowsCount(1)
+	tx.assertRowExists(1)
+	db.t.FatalOnError(tx.Rollback())
+	db.sync()
+	table.assertRowsCount(0)
+	table.assertRowDoesNotExist(1)
+}
+
+func TestContextDeadlineInterruptsRunningQuery(t *testing.T) {
+	runFileTest(t, func(t *testing.T, db *sql.DB) {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		// A recursive CTE this long keeps libsql_query_stmt busy well past
+		// the deadline, so this only returns quickly if the deadline
+		// actually interrupts the native call rather than being checked
+		// once up front.
+		_, err := db.QueryContext(ctx, "WITH RECURSIVE cnt(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM cnt WHERE x < 100000000) SELECT count(*) FROM cnt")
+		elapsed := time.Since(start)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+		}
+		if elapsed > 5*time.Second {
+			t.Fatalf("query ran for %s after its deadline; libsql_interrupt did not abort it", elapsed)
+		}
+	})
+}
+
+func TestCancelContext(t *testing.T) {
+	db := getRemoteDb(T{t})
+	testCancelContext(db)
+}
+
+func TestCancelContextEmbedded(t *testing.T) {
+	db := getEmbeddedDb(T{t})
+	testCancelContext(db)
+}
+
+func testCancelContext(db *Database) {
+	if db == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS test (id INTEGER PRIMARY KEY, name TEXT)")
+	if err == nil {
+		db.t.FatalWithMsg("should have failed")
+	}
+	if !errors.Is(err, context.Canceled) {
+		db.t.FatalWithMsg("should have failed with context.Canceled")
+	}
+}
+
+func TestCancelContextWithTransaction(t *testing.T) {
+	db := getRemoteDb(T{t})
+	testCancelContextWithTransaction(db)
+}
+
+func TestCancelContextWithTransactionEmbedded(t *testing.T) {
+	db := getEmbeddedDb(T{t})
+	testCancelContextWithTransaction(db)
+}
+
+func testCancelContextWithTransaction(db *Database) {
+	if db == nil {
+		return
+	}
+	table := db.createTable()
+	ctx, cancel := context.WithCancel(context.Background())
+	tx := table.beginTxWithContext(ctx)
+	tx.insertRows(0, 10)
+	tx.insertRowsWithArgs(10, 10)
+	tx.assertRowsCount(20)
+	tx.assertRowDoesNotExist(20)
+	tx.assertRowExists(0)
+	tx.assertRowExists(19)
+	// let's cancel the context before the commit
+	cancel()
+	err := tx.Commit()
+	if err == nil {
+		db.t.FatalWithMsg("should have failed")
+	}
+	if !errors.Is(err, context.Canceled) {
+		db.t.FatalWithMsg("should have failed with context.Canceled")
+	}
+	// rolling back the transaction should not result in any error
+	db.t.FatalOnError(tx.Rollback())
+}
+
+func TestTransactionRollback(t *testing.T) {
+	db := getRemoteDb(T{t})
+	testTransactionRollback(db)
+}
+
+func TestTransactionRollbackEmbedded(t *testing.T) {
+	db := getEmbeddedDb(T{t})
+	testTransactionRollback(db)
+}
+
+func testTransactionRollback(db *Database) {
+	if db == nil {
+		return
+	}
+	table := db.createTable()
+	tx := table.beginTx()
+	tx.insertRows(0, 10)
+	tx.insertRowsWithArgs(10, 10)
+	tx.assertRowsCount(20)
+	tx.assertRowDoesNotExist(20)
+	tx.assertRowExists(0)
+	tx.assertRowExists(19)
+	db.t.FatalOnError(tx.Rollback())
+	db.sync()
+	table.assertRowsCount(0)
+}
+
+func TestArguments(t *testing.T) {
+	db := getRemoteDb(T{t})
+	testArguments(db)
+}
+
+func TestArgumentsEmbedded(t *testing.T) {
+	db := getEmbeddedDb(T{t})
+	testArguments(db)
+}
+
+func testArguments(db *Database) {
+	if db == nil {
+		return
+	}
+	t := db.t
+	tableName := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	_, err := db.Exec(fmt.Sprintf("CREATE TABLE %s (id INTEGER, name TEXT, gpa REAL, cv BLOB);", tableName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(fmt.Sprintf("INSERT INTO %s (id, name, gpa, cv) VALUES (?, ?, ?, randomblob(10));", tableName), 0, fmt.Sprint(0), 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.sync()
+	rows, err := db.QueryContext(context.Background(), "SELECT NULL, id, name, gpa, cv FROM "+tableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	idx := 0
+	for rows.Next() {
+		if idx > 0 {
+			t.Fatal("idx should be <= ", 0)
+		}
+		var null any
+		var id int
+		var name string
+		var gpa float64
+		var cv []byte
+		if err := rows.Scan(&null, &id, &name, &gpa, &cv); err != nil {
+			t.Fatal(err)
+		}
+		if null != nil {
+			t.Fatal("null should be nil")
+		}
+		if id != int(idx) {
+			t.Fatal("id should be ", idx, " got ", id)
+		}
+		if name != fmt.Sprint(idx) {
+			t.Fatal("name should be", idx)
+		}
+		if gpa != float64(idx)+0.5 {
+			t.Fatal("gpa should be", float64(idx)+0.5)
+		}
+		if len(cv) != 10 {
+			t.Fatal("cv should be 10 bytes")
+		}
+		idx++
+	}
+	if idx != 1 {
+		t.Fatal("idx should be 1 got ", idx)
+	}
+}
+
+func TestPing(t *testing.T) {
+	db := getRemoteDb(T{t})
+	testPing(db)
+}
+
+func TestPingEmbedded(t *testing.T) {
+	db := getEmbeddedDb(T{t})
+	testPing(db)
+}
+
+func testPing(db *Database) {
+	if db == nil {
+		return
+	}
+	// This ping should succeed because the database is up and running
+	db.t.FatalOnError(db.Ping())
+
+	db.t.Cleanup(func() {
+		db.Close()
+
+		// This ping should return an error because the database is already closed
+		err := db.Ping()
+		if err == nil {
+			db.t.Fatal("db.Ping succeeded when it should have failed")
+		}
+	})
+}
+
+func TestDataTypes(t *testing.T) {
+	db := getRemoteDb(T{t})
+	testDataTypes(db)
+}
+
+func TestDataTypesEmbedded(t *testing.T) {
+	db := getEmbeddedDb(T{t})
+	testDataTypes(db)
+}
+
+func testDataTypes(db *Database) {
+	if db == nil {
+		return
+	}
+	var (
+		text        string
+		nullText    sql.NullString
+		integer     sql.NullInt64
+		nullInteger sql.NullInt64
+		boolean     bool
+		float8      float64
+		nullFloat   sql.NullFloat64
+		bytea       []byte
+		Time        time.Time
+	)
+	t := db.t
+	// The "time" column is selected from a real DATETIME column rather than
+	// a bare literal: Next only decodes a TEXT value as time.Time when
+	// libsql_column_decltype identifies the column as DATE/DATETIME/
+	// TIMESTAMP, and a literal expression has no decltype of its own.
+	tableName := "data_types_" + fmt.Sprint(rand.Int())
+	db.exec("CREATE TABLE " + tableName + " (created_at DATETIME)")
+	db.t.Cleanup(func() {
+		db.exec("DROP TABLE " + tableName)
+	})
+	db.exec("INSERT INTO "+tableName+" (created_at) VALUES (?)", "0001-01-01 01:00:00+00:00")
+	db.sync()
+	db.t.FatalOnError(db.QueryRowContext(db.ctx, "SELECT 'foobar' as text, NULL as text,  NULL as integer, 42 as integer, 1 as boolean, X'000102' as bytea, 3.14 as float8, NULL as float8, created_at as time FROM "+tableName+";").Scan(&text, &nullText, &nullInteger, &integer, &boolean, &bytea, &float8, &nullFloat, &Time))
+	switch {
+	case text != "foobar":
+		t.Error("value mismatch - text")
+	case nullText.Valid:
+		t.Error("null text is valid")
+	case nullInteger.Valid:
+		t.Error("null integer is valid")
+	case !integer.Valid:
+		t.Error("integer is not valid")
+	case integer.Int64 != 42:
+		t.Error("value mismatch - integer")
+	case !boolean:
+		t.Error("value mismatch - boolean")
+	case float8 != 3.14:
+		t.Error("value mismatch - float8")
+	case !bytes.Equal(bytea, []byte{0, 1, 2}):
+		t.Error("value mismatch - bytea")
+	case nullFloat.Valid:
+		t.Error("null float is valid")
+	case !Time.Equal(time.Time{}.Add(time.Hour)):
+		t.Error("value mismatch - time")
+	}
+}
+
+func TestConcurrentOnSingleConnection(t *testing.T) {
+	db := getRemoteDb(T{t})
+	testConcurrentOnSingleConnection(db)
+}
+
+func TestConcurrentOnSingleConnectionEmbedded(t *testing.T) {
+	db := getEmbeddedDb(T{t})
+	testConcurrentOnSingleConnection(db)
+}
+
+func testConcurrentOnSingleConnection(db *Database) {
+	if db == nil {
+		return
+	}
+	t1 := db.createTable()
+	t2 := db.createTable()
+	t3 := db.createTable()
+	t1.insertRowsInternal(1, 10, func(i int) sql.Result {
+		return t1.db.exec("INSERT INTO "+t1.name+" VALUES(?, ?)", i, i)
+	})
+	t2.insertRowsInternal(1, 10, func(i int) sql.Result {
+		return t2.db.exec("INSERT INTO "+t2.name+" VALUES(?, ?)", i, -1*i)
+	})
+	t3.insertRowsInternal(1, 10, func(i int) sql.Result {
+		return t3.db.exec("INSERT INTO "+t3.name+" VALUES(?, ?)", i, 0)
+	})
+	db.sync()
+	g, ctx := errgroup.WithContext(context.Background())
+	conn, err := db.Conn(context.Background())
+	db.t.FatalOnError(err)
+	defer conn.Close()
+	worker := func(t Table, check func(int) error) func() error {
+		return func() error {
+			for i := 1; i < 100; i++ {
 				// Each iteration is wrapped into a function to make sure that `defer rows.Close()`
 				// is called after each iteration not at the end of the outer function
 				err := func() error {
@@ -1067,295 +1733,1592 @@ func testConcurrentOnSingleConnection(db *Database) {
 					return err
 				}
 			}
-			return nil
+			return nil
+		}
+	}
+	g.Go(worker(t1, func(v int) error {
+		if v <= 0 {
+			return fmt.Errorf("got non-positive value from table1: %d", v)
+		}
+		return nil
+	}))
+	g.Go(worker(t2, func(v int) error {
+		if v >= 0 {
+			return fmt.Errorf("got non-negative value from table2: %d", v)
+		}
+		return nil
+	}))
+	g.Go(worker(t3, func(v int) error {
+		if v != 0 {
+			return fmt.Errorf("got non-zero value from table3: %d", v)
+		}
+		return nil
+	}))
+	db.t.FatalOnError(g.Wait())
+}
+
+func TestStatementCacheHitsAndInvalidation(t *testing.T) {
+	runFileTest(t, func(t *testing.T, db *sql.DB) {
+		// A single physical connection is required: the statement cache is
+		// per-connection, and Stats below reports whichever connection the
+		// pool hands it, which is only deterministic with one to hand out.
+		db.SetMaxOpenConns(1)
+		ctx := context.Background()
+		if _, err := db.ExecContext(ctx, "CREATE TABLE t (a int, b int)"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			if _, err := db.ExecContext(ctx, "INSERT INTO t VALUES (?, ?)", i, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i := 0; i < 10; i++ {
+			rows, err := db.QueryContext(ctx, "SELECT b FROM t WHERE a = ?", i%5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for rows.Next() {
+			}
+			rows.Close()
+		}
+		stats, err := Stats(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Hits == 0 {
+			t.Fatal("expected at least one statement cache hit")
+		}
+		if stats.Size != 2 {
+			t.Fatalf("expected the INSERT and the SELECT to be cached, got %d", stats.Size)
+		}
+
+		if _, err := db.ExecContext(ctx, "ALTER TABLE t ADD COLUMN c int"); err != nil {
+			t.Fatal(err)
+		}
+		stats, err = Stats(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Size != 0 {
+			t.Fatalf("expected the cache to be emptied by the ALTER TABLE, got size %d", stats.Size)
+		}
+
+		if _, err := db.QueryContext(ctx, "SELECT a FROM t WHERE a = 0"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestStatementCacheDisabled(t *testing.T) {
+	dir, err := os.MkdirTemp("", "libsql-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("libsql", "file:"+dir+"/test.db?_stmt_cache_size=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, "CREATE TABLE t (a int)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.QueryContext(ctx, "SELECT a FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	stats, err := Stats(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Hits != 0 || stats.Misses != 0 || stats.Size != 0 {
+		t.Fatalf("expected no cache activity with _stmt_cache_size=0, got %+v", stats)
+	}
+}
+
+// benchmarkConcurrentOnSingleConnection reruns the workload from
+// testConcurrentOnSingleConnection against a file database opened with dsn
+// suffix, so BenchmarkConcurrentOnSingleConnection can compare the cached and
+// uncached statement-preparation paths.
+func benchmarkConcurrentOnSingleConnection(b *testing.B, dsnSuffix string) {
+	dir, err := os.MkdirTemp("", "libsql-*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("libsql", "file:"+dir+"/test.db"+dsnSuffix)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, "CREATE TABLE bench (a int, b int)"); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := db.ExecContext(ctx, "INSERT INTO bench VALUES (?, ?)", i, i); err != nil {
+			b.Fatal(err)
+		}
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	b.ResetTimer()
+	g, gCtx := errgroup.WithContext(ctx)
+	for worker := 0; worker < 4; worker++ {
+		g.Go(func() error {
+			for i := 0; i < b.N; i++ {
+				rows, err := conn.QueryContext(gCtx, "SELECT b FROM bench")
+				if err != nil {
+					return err
+				}
+				for rows.Next() {
+				}
+				if err := rows.Err(); err != nil {
+					rows.Close()
+					return err
+				}
+				rows.Close()
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkConcurrentOnSingleConnection(b *testing.B) {
+	b.Run("Cached", func(b *testing.B) {
+		benchmarkConcurrentOnSingleConnection(b, "")
+	})
+	b.Run("Uncached", func(b *testing.B) {
+		benchmarkConcurrentOnSingleConnection(b, "?_stmt_cache_size=0")
+	})
+}
+
+func runFileTest(t *testing.T, test func(*testing.T, *sql.DB)) {
+	dir, err := os.MkdirTemp("", "libsql-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("libsql", "file:"+dir+"/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	test(t, db)
+}
+
+func runMemoryAndFileTests(t *testing.T, test func(*testing.T, *sql.DB)) {
+	t.Parallel()
+	t.Run("Memory", func(t *testing.T) {
+		t.Parallel()
+		db, err := sql.Open("libsql", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		test(t, db)
+	})
+	t.Run("File", func(t *testing.T) {
+		runFileTest(t, test)
+	})
+}
+
+func doTestOpen(t *testing.T, dsnQueries map[string]bool) {
+	for query, wantOK := range dsnQueries {
+		query, wantOK := query, wantOK
+		t.Run(query, func(t *testing.T) {
+			t.Parallel()
+			dir, err := os.MkdirTemp("", "libsql-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			dsn := "file:" + dir + "/test.db"
+			if query != "" {
+				dsn += "?" + query
+			}
+			db, openErr := sql.Open("libsql", dsn)
+			if !wantOK {
+				if openErr == nil {
+					db.Close()
+					t.Fatalf("expected %q to fail to open", query)
+				}
+				return
+			}
+			if openErr != nil {
+				t.Fatalf("unexpected error opening %q: %v", query, openErr)
+			}
+			defer db.Close()
+			if _, err := db.Exec("SELECT 1"); err != nil {
+				t.Fatalf("unexpected error using a connection opened with %q: %v", query, err)
+			}
+		})
+	}
+}
+
+func TestOpenConnParams(t *testing.T) {
+	doTestOpen(t, map[string]bool{
+		"":                                    true,
+		"_txlock=deferred":                    true,
+		"_txlock=immediate":                   true,
+		"_txlock=exclusive":                   true,
+		"_txlock=bogus":                       false,
+		"_journal_mode=WAL":                   true,
+		"_busy_timeout=5000":                  true,
+		"_foreign_keys=1":                     true,
+		"_synchronous=NORMAL":                 true,
+		"_cache_size=2000":                    true,
+		"_txlock=immediate&_journal_mode=WAL": true,
+		"_bogus=1":                            false,
+		"_max_retries=0":                      true,
+		"_max_retries=-1":                     false,
+		"_max_retries=bogus":                  false,
+		"_retry_backoff=exponential":          true,
+		"_retry_backoff=none":                 true,
+		"_retry_backoff=bogus":                false,
+	})
+}
+
+func TestTxLockAppliesToBeginTx(t *testing.T) {
+	dir, err := os.MkdirTemp("", "libsql-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("libsql", "file:"+dir+"/test.db?_txlock=immediate&_journal_mode=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var journalMode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.EqualFold(journalMode, "wal") {
+		t.Fatalf("expected journal_mode to be wal, got %q", journalMode)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("expected BEGIN IMMEDIATE TRANSACTION to succeed, got %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrorNonUtf8URL(t *testing.T) {
+	t.Parallel()
+	db, err := sql.Open("libsql", "file:a\xc5z")
+	if err == nil {
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		t.Fatal("expected error")
+	}
+	if err.Error() != "failed to open local database file:a\xc5z\nerror code = 1: Wrong URL: invalid utf-8 sequence of 1 bytes from index 6" {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestErrorWrongURL(t *testing.T) {
+	t.Skip("Does not work with v2")
+	t.Parallel()
+	db, err := sql.Open("libsql", "http://example.com/test")
+	if err == nil {
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		t.Fatal("expected error")
+	}
+	if err.Error() != "failed to open database http://example.com/test\nerror code = 1: Error opening URL http://example.com/test: Failed to connect to database: `Unable to open remote database http://example.com/test with Database::open()`" {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestErrorCanNotConnect(t *testing.T) {
+	t.Parallel()
+	db, err := sql.Open("libsql", "file:/root/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	conn, err := db.Conn(context.Background())
+	if err == nil {
+		defer func() {
+			if err := conn.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		t.Fatal("expected error")
+	}
+	if err.Error() != "failed to connect to database\nerror code = 1: Unable to connect: Failed to connect to database: `file:/root/test.db`" {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestExec(t *testing.T) {
+	runMemoryAndFileTests(t, func(t *testing.T, db *sql.DB) {
+		if _, err := db.ExecContext(context.Background(), "CREATE TABLE test (id INTEGER, name TEXT)"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestExecWithQuery(t *testing.T) {
+	runMemoryAndFileTests(t, func(t *testing.T, db *sql.DB) {
+		if _, err := db.QueryContext(context.Background(), "SELECT 1"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestErrorExec(t *testing.T) {
+	runMemoryAndFileTests(t, func(t *testing.T, db *sql.DB) {
+		_, err := db.ExecContext(context.Background(), "CREATE TABLES test (id INTEGER, name TEXT)")
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if err.Error() != "failed to execute query CREATE TABLES test (id INTEGER, name TEXT)\nerror code = 2: Error executing statement: SQLite failure: `near \"TABLES\": syntax error`" {
+			t.Fatal("unexpected error:", err)
+		}
+		var libsqlErr *Error
+		if !errors.As(err, &libsqlErr) {
+			t.Fatalf("expected errors.As to find a *Error, got %T", err)
+		}
+		if libsqlErr.Code != 2 {
+			t.Fatalf("expected Error.Code 2, got %d", libsqlErr.Code)
+		}
+	})
+}
+
+func TestQuery(t *testing.T) {
+	runMemoryAndFileTests(t, func(t *testing.T, db *sql.DB) {
+		if _, err := db.ExecContext(context.Background(), "CREATE TABLE test (id INTEGER, name TEXT, gpa REAL, cv BLOB)"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if _, err := db.ExecContext(context.Background(), "INSERT INTO test VALUES(?, ?, ?, randomblob(10))", i, fmt.Sprint(i), float64(i)+0.5); err != nil {
+				t.Fatal(err)
+			}
+		}
+		rows, err := db.QueryContext(context.Background(), "SELECT NULL, id, name, gpa, cv FROM test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		columns, err := rows.Columns()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.DeepEqual(t, columns, []string{"NULL", "id", "name", "gpa", "cv"})
+		types, err := rows.ColumnTypes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(types) != 5 {
+			t.Fatal("types should be 5")
+		}
+		defer rows.Close()
+		idx := 0
+		for rows.Next() {
+			var null any
+			var id int
+			var name string
+			var gpa float64
+			var cv []byte
+			if err := rows.Scan(&null, &id, &name, &gpa, &cv); err != nil {
+				t.Fatal(err)
+			}
+			if null != nil {
+				t.Fatal("null should be nil")
+			}
+			if id != int(idx) {
+				t.Fatal("id should be", idx)
+			}
+			if name != fmt.Sprint(idx) {
+				t.Fatal("name should be", idx)
+			}
+			if gpa != float64(idx)+0.5 {
+				t.Fatal("gpa should be", float64(idx)+0.5)
+			}
+			if len(cv) != 10 {
+				t.Fatal("cv should be 10 bytes")
+			}
+			idx++
+		}
+	})
+}
+
+func TestErrorQuery(t *testing.T) {
+	runMemoryAndFileTests(t, func(t *testing.T, db *sql.DB) {
+		rows, err := db.QueryContext(context.Background(), "SELECT NULL, id, name, gpa, cv FROM test")
+		if rows != nil {
+			rows.Close()
+		}
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if err.Error() != "failed to execute query SELECT NULL, id, name, gpa, cv FROM test\nerror code = 1: Error executing statement: SQLite failure: `no such table: test`" {
+			t.Fatal("unexpected error:", err)
+		}
+	})
+}
+
+func TestQueryWithEmptyResult(t *testing.T) {
+	runMemoryAndFileTests(t, func(t *testing.T, db *sql.DB) {
+		if _, err := db.ExecContext(context.Background(), "CREATE TABLE test (id INTEGER, name TEXT, gpa REAL, cv BLOB)"); err != nil {
+			t.Fatal(err)
+		}
+		rows, err := db.QueryContext(context.Background(), "SELECT NULL, id, name, gpa, cv FROM test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		columns, err := rows.Columns()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.DeepEqual(t, columns, []string{"NULL", "id", "name", "gpa", "cv"})
+		types, err := rows.ColumnTypes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(types) != 5 {
+			t.Fatal("types should be 5")
+		}
+		for rows.Next() {
+			t.Fatal("there should be no rows")
+		}
+	})
+}
+
+func TestErrorRowsNext(t *testing.T) {
+	runFileTest(t, func(t *testing.T, db *sql.DB) {
+		db.Exec("PRAGMA journal_mode=DELETE")
+		if _, err := db.ExecContext(context.Background(), "CREATE TABLE test (id INTEGER)"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if _, err := db.ExecContext(context.Background(), "INSERT INTO test VALUES("+fmt.Sprint(i)+")"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c1, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c1.Close()
+		c1.ExecContext(context.Background(), "PRAGMA journal_mode=DELETE")
+		c2, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c2.Close()
+		c2.ExecContext(context.Background(), "PRAGMA journal_mode=DELETE")
+		_, err = c1.ExecContext(context.Background(), "BEGIN EXCLUSIVE TRANSACTION")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := c2.QueryContext(context.Background(), "SELECT id FROM test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		if rows.Next() {
+			t.Fatal("there should be no rows")
+		}
+		err = rows.Err()
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if err.Error() != "failed to get next row\nerror code = 1: Error fetching next row: SQLite failure: `database is locked`" {
+			t.Fatal("unexpected error:", err)
+		}
+	})
+}
+
+func TestAutoRetryOnDatabaseLocked(t *testing.T) {
+	runFileTest(t, func(t *testing.T, db *sql.DB) {
+		ctx := context.Background()
+		if _, err := db.ExecContext(ctx, "CREATE TABLE t (id INTEGER)"); err != nil {
+			t.Fatal(err)
+		}
+		db.SetMaxOpenConns(2)
+		c1, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c1.Close()
+		c1.ExecContext(ctx, "PRAGMA journal_mode=DELETE")
+		c2, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c2.Close()
+		c2.ExecContext(ctx, "PRAGMA journal_mode=DELETE")
+
+		if _, err := c1.ExecContext(ctx, "BEGIN EXCLUSIVE TRANSACTION"); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			c1.ExecContext(context.Background(), "COMMIT")
+		}()
+
+		// c2's insert sees "database is locked" at first, same as
+		// TestErrorRowsNext above, because c1 holds an exclusive lock. The
+		// default retry policy (see WithMaxRetries) should wait it out
+		// rather than surfacing the error, so this only fails if automatic
+		// retry regresses.
+		if _, err := c2.ExecContext(ctx, "INSERT INTO t VALUES (1)"); err != nil {
+			t.Fatalf("expected automatic retry to ride out the exclusive transaction, got %v", err)
 		}
+	})
+}
+
+func TestMaxRetriesDSNParamDisablesRetry(t *testing.T) {
+	dir, err := os.MkdirTemp("", "libsql-*")
+	if err != nil {
+		t.Fatal(err)
 	}
-	g.Go(worker(t1, func(v int) error {
-		if v <= 0 {
-			return fmt.Errorf("got non-positive value from table1: %d", v)
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("libsql", "file:"+dir+"/test.db?_max_retries=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, "CREATE TABLE t (id INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(2)
+	c1, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c1.ExecContext(ctx, "PRAGMA journal_mode=DELETE")
+	c2, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	c2.ExecContext(ctx, "PRAGMA journal_mode=DELETE")
+
+	if _, err := c1.ExecContext(ctx, "BEGIN EXCLUSIVE TRANSACTION"); err != nil {
+		t.Fatal(err)
+	}
+	defer c1.ExecContext(context.Background(), "COMMIT")
+
+	// _max_retries=0 leaves c2 nothing to wait out, so the "database is
+	// locked" error from c1's exclusive transaction must surface right away.
+	if _, err := c2.ExecContext(ctx, "INSERT INTO t VALUES (1)"); err == nil {
+		t.Fatal("expected INSERT to fail immediately with _max_retries=0")
+	}
+}
+
+func TestRetrySkippedOnceTransactionStarted(t *testing.T) {
+	runFileTest(t, func(t *testing.T, db *sql.DB) {
+		ctx := context.Background()
+		if _, err := db.ExecContext(ctx, "CREATE TABLE t (id INTEGER)"); err != nil {
+			t.Fatal(err)
 		}
-		return nil
-	}))
-	g.Go(worker(t2, func(v int) error {
-		if v >= 0 {
-			return fmt.Errorf("got non-negative value from table2: %d", v)
+		db.SetMaxOpenConns(2)
+		c1, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
 		}
-		return nil
-	}))
-	g.Go(worker(t3, func(v int) error {
-		if v != 0 {
-			return fmt.Errorf("got non-zero value from table3: %d", v)
+		defer c1.Close()
+		c1.ExecContext(ctx, "PRAGMA journal_mode=DELETE")
+		c2, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
 		}
-		return nil
-	}))
-	db.t.FatalOnError(g.Wait())
+		defer c2.Close()
+		c2.ExecContext(ctx, "PRAGMA journal_mode=DELETE")
+
+		if _, err := c1.ExecContext(ctx, "BEGIN EXCLUSIVE TRANSACTION"); err != nil {
+			t.Fatal(err)
+		}
+		defer c1.ExecContext(context.Background(), "COMMIT")
+
+		tx, err := c2.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+
+		// c2 already has a transaction open (a plain deferred BEGIN on its
+		// own connection, which takes no lock and so succeeds while c1 holds
+		// the exclusive one), so retryingOp must not retry its failing
+		// statement -- the "database is locked" error should surface
+		// immediately rather than after the usual retry/backoff window.
+		if _, err := tx.ExecContext(ctx, "INSERT INTO t VALUES (1)"); err == nil {
+			t.Fatal("expected INSERT to fail immediately once a transaction has started")
+		}
+	})
+}
+
+func TestDefaultRetryableErrorClassifiesConnectionLoss(t *testing.T) {
+	for _, msg := range []string{
+		"read tcp 127.0.0.1:443: connection reset by peer",
+		"dial tcp 127.0.0.1:443: connection refused",
+		"write: broken pipe",
+		"unexpected EOF",
+		"dial tcp: i/o timeout",
+		"dial tcp: lookup sqld.example: no such host",
+		"use of closed network connection",
+	} {
+		if !defaultRetryableError(fmt.Errorf("hrana request failed: %s", msg)) {
+			t.Errorf("expected %q to be classified as a retryable connection-lost error", msg)
+		}
+	}
+	if defaultRetryableError(fmt.Errorf("syntax error near SELECT")) {
+		t.Fatal("expected a syntax error not to be classified as retryable")
+	}
+}
+
+func TestWithRetryPolicyConflictsWithIndividualRetryOptions(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewEmbeddedReplicaConnector(dir+"/test.db", "http://127.0.0.1:1", WithRetryPolicy(DefaultRetryPolicy()), WithMaxRetries(1))
+	if err == nil {
+		t.Fatal("expected WithRetryPolicy combined with WithMaxRetries to fail")
+	}
+}
+
+// TestReconnect verifies that a connection lost mid-request against the
+// remote primary is retried transparently rather than surfacing to the
+// caller. A small TCP proxy sits in front of the real primary: its first
+// accepted connection is reset as soon as data arrives, simulating sqld's
+// HTTP endpoint being killed mid-query (à la lib/pq's reconnect test), and
+// every connection after that is forwarded normally so the retried attempt
+// succeeds.
+func TestReconnect(t *testing.T) {
+	primaryUrl := os.Getenv("LIBSQL_PRIMARY_URL")
+	if primaryUrl == "" {
+		t.Skip("LIBSQL_PRIMARY_URL is not set")
+		return
+	}
+	authToken := os.Getenv("LIBSQL_AUTH_TOKEN")
+
+	u, err := url.Parse(primaryUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		upstream = net.JoinHostPort(u.Host, port)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var killedOnce atomic.Bool
+	go func() {
+		for {
+			downstream, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go reconnectProxyConn(downstream, upstream, &killedOnce)
+		}
+	}()
+
+	u.Host = ln.Addr().String()
+	proxyUrl := u.String()
+
+	var opts []Option
+	if authToken != "" {
+		opts = append(opts, WithAuthToken(authToken))
+	}
+	opts = append(opts, WithReadYourWrites(false))
+	dir := t.TempDir()
+	connector, err := NewEmbeddedReplicaConnector(dir+"/test.db", proxyUrl, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connector.Close()
+
+	if err := connector.Sync(); err != nil {
+		t.Fatalf("expected the reset first connection attempt to be retried transparently, got: %v", err)
+	}
+	if !killedOnce.Load() {
+		t.Fatal("proxy never saw a connection to kill; test did not exercise the reconnect path")
+	}
 }
 
-func runFileTest(t *testing.T, test func(*testing.T, *sql.DB)) {
+// reconnectProxyConn forwards downstream to upstreamAddr, except the very
+// first call resets the connection as soon as the caller writes to it
+// instead of forwarding anything -- simulating sqld's endpoint disappearing
+// mid-request.
+func reconnectProxyConn(downstream net.Conn, upstreamAddr string, killedOnce *atomic.Bool) {
+	defer downstream.Close()
+	if killedOnce.CompareAndSwap(false, true) {
+		buf := make([]byte, 1)
+		downstream.Read(buf)
+		downstream.(*net.TCPConn).SetLinger(0)
+		return
+	}
+
+	upstream, err := net.Dial("tcp", upstreamAddr)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(upstream, downstream); done <- struct{}{} }()
+	go func() { io.Copy(downstream, upstream); done <- struct{}{} }()
+	<-done
+}
+
+func TestRunInTxCommitsAndRollsBack(t *testing.T) {
 	dir, err := os.MkdirTemp("", "libsql-*")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(dir)
-	db, err := sql.Open("libsql", "file:"+dir+"/test.db")
+	sqlConnector, err := (driver{}).OpenConnector("file:" + dir + "/test.db")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer func() {
-		if err := db.Close(); err != nil {
-			t.Fatal(err)
+	connector := sqlConnector.(*Connector)
+	defer connector.Close()
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, "CREATE TABLE t (id INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := connector.RunInTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "INSERT INTO t VALUES (1)")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM t").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expected RunInTx to commit its insert, got %d rows", count)
+	}
+
+	wantErr := errors.New("rollback me")
+	err = connector.RunInTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO t VALUES (2)"); err != nil {
+			return err
 		}
-	}()
-	test(t, db)
+		return wantErr
+	})
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("expected RunInTx to return the function's error, got %v", err)
+	}
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM t").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expected RunInTx to roll back the failed insert, got %d rows", count)
+	}
 }
 
-func runMemoryAndFileTests(t *testing.T, test func(*testing.T, *sql.DB)) {
-	t.Parallel()
-	t.Run("Memory", func(t *testing.T) {
-		t.Parallel()
-		db, err := sql.Open("libsql", ":memory:")
-		if err != nil {
+func TestTimeRoundTrip(t *testing.T) {
+	runFileTest(t, func(t *testing.T, db *sql.DB) {
+		if _, err := db.Exec("CREATE TABLE t (created_at DATETIME, label TEXT)"); err != nil {
 			t.Fatal(err)
 		}
-		defer func() {
-			if err := db.Close(); err != nil {
-				t.Fatal(err)
-			}
-		}()
-		test(t, db)
-	})
-	t.Run("File", func(t *testing.T) {
-		runFileTest(t, test)
+		want := time.Date(2024, 3, 15, 9, 30, 0, 0, time.UTC)
+		if _, err := db.Exec("INSERT INTO t (created_at, label) VALUES (?, ?)", want, "2024-03-15"); err != nil {
+			t.Fatal(err)
+		}
+		var got time.Time
+		if err := db.QueryRow("SELECT created_at FROM t").Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(want) {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+
+		// label holds the same TEXT as a valid date but has no DATE/
+		// DATETIME/TIMESTAMP decltype, so it must stay a string rather than
+		// being sniffed into a time.Time.
+		var label string
+		if err := db.QueryRow("SELECT label FROM t").Scan(&label); err != nil {
+			t.Fatal(err)
+		}
+		if label != "2024-03-15" {
+			t.Fatalf("expected label to stay a string, got %q", label)
+		}
 	})
 }
 
-func TestErrorNonUtf8URL(t *testing.T) {
-	t.Parallel()
-	db, err := sql.Open("libsql", "file:a\xc5z")
-	if err == nil {
-		defer func() {
-			if err := db.Close(); err != nil {
-				t.Fatal(err)
-			}
-		}()
-		t.Fatal("expected error")
+func TestTimeFormatUnix(t *testing.T) {
+	dir, err := os.MkdirTemp("", "libsql-*")
+	if err != nil {
+		t.Fatal(err)
 	}
-	if err.Error() != "failed to open local database file:a\xc5z\nerror code = 1: Wrong URL: invalid utf-8 sequence of 1 bytes from index 6" {
-		t.Fatal("unexpected error:", err)
+	defer os.RemoveAll(dir)
+	sqlConnector, err := (driver{}).OpenConnector("file:" + dir + "/test.db")
+	if err != nil {
+		t.Fatal(err)
 	}
-}
+	connector := sqlConnector.(*Connector)
+	connector.timeFormat = TimeFormatUnix
+	defer connector.Close()
+	db := sql.OpenDB(connector)
+	defer db.Close()
 
-func TestErrorWrongURL(t *testing.T) {
-	t.Skip("Does not work with v2")
-	t.Parallel()
-	db, err := sql.Open("libsql", "http://example.com/test")
-	if err == nil {
-		defer func() {
-			if err := db.Close(); err != nil {
-				t.Fatal(err)
-			}
-		}()
-		t.Fatal("expected error")
+	if _, err := db.Exec("CREATE TABLE t (created_at DATETIME)"); err != nil {
+		t.Fatal(err)
 	}
-	if err.Error() != "failed to open database http://example.com/test\nerror code = 1: Error opening URL http://example.com/test: Failed to connect to database: `Unable to open remote database http://example.com/test with Database::open()`" {
-		t.Fatal("unexpected error:", err)
+	want := time.Date(2024, 3, 15, 9, 30, 0, 0, time.UTC)
+	if _, err := db.Exec("INSERT INTO t VALUES (?)", want); err != nil {
+		t.Fatal(err)
+	}
+	var stored time.Time
+	if err := db.QueryRow("SELECT created_at FROM t").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Equal(want) {
+		t.Fatalf("expected %v, got %v", want, stored)
 	}
 }
 
-func TestErrorCanNotConnect(t *testing.T) {
-	t.Parallel()
-	db, err := sql.Open("libsql", "file:/root/test.db")
+func TestBindNumericTypesAndOverflow(t *testing.T) {
+	dir, err := os.MkdirTemp("", "libsql-*")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer func() {
-		if err := db.Close(); err != nil {
+	defer os.RemoveAll(dir)
+	sqlConnector, err := (driver{}).OpenConnector("file:" + dir + "/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connector := sqlConnector.(*Connector)
+	defer connector.Close()
+	driverConn, err := connector.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := driverConn.(*conn)
+	defer c.Close()
+
+	if _, err := c.ExecContext(context.Background(), "CREATE TABLE t (a INTEGER, b INTEGER, c INTEGER)", nil); err != nil {
+		t.Fatal(err)
+	}
+	// These bypass database/sql's own argument conversion (which would
+	// normalize int/int32/uint64 to int64 before ever reaching conn), so
+	// this exercises conn.execute's own int/int32/uint64 cases directly.
+	args := []sqldriver.NamedValue{
+		{Ordinal: 1, Value: int(7)},
+		{Ordinal: 2, Value: int32(8)},
+		{Ordinal: 3, Value: uint64(9)},
+	}
+	if _, err := c.ExecContext(context.Background(), "INSERT INTO t VALUES (?, ?, ?)", args); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := c.QueryContext(context.Background(), "SELECT a, b, c FROM t", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	dest := make([]sqldriver.Value, 3)
+	if err := rows.Next(dest); err != nil {
+		t.Fatal(err)
+	}
+	if dest[0].(int64) != 7 || dest[1].(int64) != 8 || dest[2].(int64) != 9 {
+		t.Fatalf("expected 7, 8, 9, got %v, %v, %v", dest[0], dest[1], dest[2])
+	}
+
+	overflowArgs := []sqldriver.NamedValue{{Ordinal: 1, Value: uint64(math.MaxInt64) + 1}}
+	_, err = c.ExecContext(context.Background(), "INSERT INTO t (a) VALUES (?)", overflowArgs)
+	if err == nil || !strings.Contains(err.Error(), "overflows int64") {
+		t.Fatalf("expected an overflow error, got %v", err)
+	}
+}
+
+func TestRowsColumnTypeMetadata(t *testing.T) {
+	runFileTest(t, func(t *testing.T, db *sql.DB) {
+		ctx := context.Background()
+		if _, err := db.ExecContext(ctx, "CREATE TABLE t (id INTEGER NOT NULL, name VARCHAR(32), price DECIMAL(10,2), data BLOB)"); err != nil {
 			t.Fatal(err)
 		}
-	}()
-	conn, err := db.Conn(context.Background())
-	if err == nil {
-		defer func() {
-			if err := conn.Close(); err != nil {
+		rows, err := db.QueryContext(ctx, "SELECT id, name, price, data, id + 1 AS next_id FROM t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		types, err := rows.ColumnTypes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(types) != 5 {
+			t.Fatalf("expected 5 columns, got %d", len(types))
+		}
+
+		if got := types[0].DatabaseTypeName(); got != "INTEGER" {
+			t.Errorf("id: expected DatabaseTypeName INTEGER, got %q", got)
+		}
+		if got := types[0].ScanType(); got != reflect.TypeOf(int64(0)) {
+			t.Errorf("id: expected ScanType int64, got %v", got)
+		}
+		if nullable, ok := types[0].Nullable(); !ok || nullable {
+			t.Errorf("id: expected declared NOT NULL, got nullable=%v ok=%v", nullable, ok)
+		}
+
+		if got := types[1].DatabaseTypeName(); got != "VARCHAR(32)" {
+			t.Errorf("name: expected DatabaseTypeName VARCHAR(32), got %q", got)
+		}
+		if got := types[1].ScanType(); got != reflect.TypeOf("") {
+			t.Errorf("name: expected ScanType string, got %v", got)
+		}
+		if length, ok := types[1].Length(); !ok || length != 32 {
+			t.Errorf("name: expected length 32, got %d ok=%v", length, ok)
+		}
+		if nullable, ok := types[1].Nullable(); !ok || !nullable {
+			t.Errorf("name: expected nullable, got nullable=%v ok=%v", nullable, ok)
+		}
+
+		if precision, scale, ok := types[2].PrecisionScale(); !ok || precision != 10 || scale != 2 {
+			t.Errorf("price: expected precision 10 scale 2, got %d, %d, ok=%v", precision, scale, ok)
+		}
+
+		if got := types[3].ScanType(); got != reflect.TypeOf([]byte(nil)) {
+			t.Errorf("data: expected ScanType []byte, got %v", got)
+		}
+		if length, ok := types[3].Length(); !ok || length != math.MaxInt64 {
+			t.Errorf("data: expected unbounded length, got %d ok=%v", length, ok)
+		}
+
+		if got := types[4].DatabaseTypeName(); got != "" {
+			t.Errorf("next_id: expected no declared type for an expression column, got %q", got)
+		}
+	})
+}
+
+func TestPreparedStatementReuseAcrossExecs(t *testing.T) {
+	runFileTest(t, func(t *testing.T, db *sql.DB) {
+		ctx := context.Background()
+		if _, err := db.ExecContext(ctx, "CREATE TABLE t (a INTEGER)"); err != nil {
+			t.Fatal(err)
+		}
+
+		insertStmt, err := db.PrepareContext(ctx, "INSERT INTO t VALUES (?)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := insertStmt.ExecContext(ctx, i); err != nil {
+				t.Fatalf("exec %d: %v", i, err)
+			}
+		}
+		if err := insertStmt.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		queryStmt, err := db.PrepareContext(ctx, "SELECT a FROM t WHERE a = ?")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer queryStmt.Close()
+		for i := 0; i < 3; i++ {
+			rows, err := queryStmt.QueryContext(ctx, i)
+			if err != nil {
+				t.Fatalf("query %d: %v", i, err)
+			}
+			if !rows.Next() {
+				t.Fatalf("query %d: expected a row", i)
+			}
+			var a int
+			if err := rows.Scan(&a); err != nil {
 				t.Fatal(err)
 			}
-		}()
-		t.Fatal("expected error")
-	}
-	if err.Error() != "failed to connect to database\nerror code = 1: Unable to connect: Failed to connect to database: `file:/root/test.db`" {
-		t.Fatal("unexpected error:", err)
-	}
+			if a != i {
+				t.Fatalf("query %d: expected %d, got %d", i, i, a)
+			}
+			rows.Close()
+		}
+	})
 }
 
-func TestExec(t *testing.T) {
+func TestNamedParametersBindByPositionNotCallOrder(t *testing.T) {
 	runMemoryAndFileTests(t, func(t *testing.T, db *sql.DB) {
-		if _, err := db.ExecContext(context.Background(), "CREATE TABLE test (id INTEGER, name TEXT)"); err != nil {
+		ctx := context.Background()
+		if _, err := db.ExecContext(ctx, "CREATE TABLE t (a INTEGER, b TEXT, c REAL)"); err != nil {
 			t.Fatal(err)
 		}
+
+		// b and c are passed out of the order they appear in the statement
+		// (":b" before ":c" in the call, but ":c" before ":b" in the SQL),
+		// which only binds correctly if named arguments are resolved by
+		// where they occur in the statement rather than by their position
+		// in this call's argument list.
+		if _, err := db.ExecContext(ctx, "INSERT INTO t VALUES (:a, :b, :c)",
+			sql.Named("a", 1), sql.Named("c", 2.5), sql.Named("b", "x")); err != nil {
+			t.Fatal(err)
+		}
+
+		var a int
+		var b string
+		var c float64
+		if err := db.QueryRowContext(ctx, "SELECT a, b, c FROM t").Scan(&a, &b, &c); err != nil {
+			t.Fatal(err)
+		}
+		if a != 1 || b != "x" || c != 2.5 {
+			t.Fatalf("expected (1, x, 2.5), got (%d, %q, %v)", a, b, c)
+		}
 	})
 }
 
-func TestExecWithQuery(t *testing.T) {
+func TestNamedParameterRepeatedInStatement(t *testing.T) {
 	runMemoryAndFileTests(t, func(t *testing.T, db *sql.DB) {
-		if _, err := db.QueryContext(context.Background(), "SELECT 1"); err != nil {
+		ctx := context.Background()
+		if _, err := db.ExecContext(ctx, "CREATE TABLE t (a INTEGER)"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.ExecContext(ctx, "INSERT INTO t VALUES (@v)", sql.Named("v", 7)); err != nil {
+			t.Fatal(err)
+		}
+		var count int
+		if err := db.QueryRowContext(ctx, "SELECT count(*) FROM t WHERE a = @v OR a = @v", sql.Named("v", 7)).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Fatalf("expected 1 matching row, got %d", count)
+		}
+	})
+}
+
+func TestPreparedStatementNamedParameters(t *testing.T) {
+	runFileTest(t, func(t *testing.T, db *sql.DB) {
+		ctx := context.Background()
+		if _, err := db.ExecContext(ctx, "CREATE TABLE t (a INTEGER, b TEXT)"); err != nil {
+			t.Fatal(err)
+		}
+		insertStmt, err := db.PrepareContext(ctx, "INSERT INTO t VALUES ($a, $b)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer insertStmt.Close()
+		if _, err := insertStmt.ExecContext(ctx, sql.Named("b", "hi"), sql.Named("a", 42)); err != nil {
+			t.Fatal(err)
+		}
+		var a int
+		var b string
+		if err := db.QueryRowContext(ctx, "SELECT a, b FROM t").Scan(&a, &b); err != nil {
+			t.Fatal(err)
+		}
+		if a != 42 || b != "hi" {
+			t.Fatalf("expected (42, hi), got (%d, %q)", a, b)
+		}
+	})
+}
+
+func TestReadOnlyTransaction(t *testing.T) {
+	runFileTest(t, func(t *testing.T, db *sql.DB) {
+		ctx := context.Background()
+		if _, err := db.ExecContext(ctx, "CREATE TABLE t (a INTEGER)"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.ExecContext(ctx, "INSERT INTO t VALUES (1)"); err != nil {
+			t.Fatal(err)
+		}
+
+		tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var a int
+		if err := tx.QueryRowContext(ctx, "SELECT a FROM t").Scan(&a); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO t VALUES (2)"); err == nil {
+			t.Fatal("expected a write inside a read-only transaction to fail")
+		}
+		if err := tx.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+
+		// PRAGMA query_only must be restored, so a write outside the
+		// transaction succeeds again.
+		if _, err := db.ExecContext(ctx, "INSERT INTO t VALUES (3)"); err != nil {
+			t.Fatalf("expected query_only to be restored after Rollback, got %v", err)
+		}
+	})
+}
+
+func TestSerializableIsolationUsesBeginImmediate(t *testing.T) {
+	runFileTest(t, func(t *testing.T, db *sql.DB) {
+		db.SetMaxOpenConns(2)
+		ctx := context.Background()
+		if _, err := db.ExecContext(ctx, "CREATE TABLE t (a INTEGER)"); err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		tx, err := conn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// BEGIN IMMEDIATE already holds the write lock, so a concurrent
+		// connection's write must fail immediately rather than block.
+		otherConn, err := db.Conn(ctx)
+		if err != nil {
 			t.Fatal(err)
 		}
-	})
-}
-
-func TestErrorExec(t *testing.T) {
-	runMemoryAndFileTests(t, func(t *testing.T, db *sql.DB) {
-		_, err := db.ExecContext(context.Background(), "CREATE TABLES test (id INTEGER, name TEXT)")
-		if err == nil {
-			t.Fatal("expected error")
+		defer otherConn.Close()
+		if _, err := otherConn.ExecContext(ctx, "INSERT INTO t VALUES (1)"); err == nil {
+			t.Fatal("expected a concurrent write to fail while the serializable transaction holds the write lock")
 		}
-		if err.Error() != "failed to execute query CREATE TABLES test (id INTEGER, name TEXT)\nerror code = 2: Error executing statement: SQLite failure: `near \"TABLES\": syntax error`" {
-			t.Fatal("unexpected error:", err)
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
 		}
 	})
 }
 
-func TestQuery(t *testing.T) {
-	runMemoryAndFileTests(t, func(t *testing.T, db *sql.DB) {
-		if _, err := db.ExecContext(context.Background(), "CREATE TABLE test (id INTEGER, name TEXT, gpa REAL, cv BLOB)"); err != nil {
+func TestNestedTransactionUsesSavepoint(t *testing.T) {
+	runFileTest(t, func(t *testing.T, db *sql.DB) {
+		db.SetMaxOpenConns(1)
+		ctx := context.Background()
+		if _, err := db.ExecContext(ctx, "CREATE TABLE t (a INTEGER)"); err != nil {
 			t.Fatal(err)
 		}
-		for i := 0; i < 10; i++ {
-			if _, err := db.ExecContext(context.Background(), "INSERT INTO test VALUES(?, ?, ?, randomblob(10))", i, fmt.Sprint(i), float64(i)+0.5); err != nil {
-				t.Fatal(err)
-			}
-		}
-		rows, err := db.QueryContext(context.Background(), "SELECT NULL, id, name, gpa, cv FROM test")
+
+		conn, err := db.Conn(ctx)
 		if err != nil {
 			t.Fatal(err)
 		}
-		columns, err := rows.Columns()
+		defer conn.Close()
+
+		outer, err := conn.BeginTx(ctx, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
-		assert.DeepEqual(t, columns, []string{"NULL", "id", "name", "gpa", "cv"})
-		types, err := rows.ColumnTypes()
+		if _, err := outer.ExecContext(ctx, "INSERT INTO t VALUES (1)"); err != nil {
+			t.Fatal(err)
+		}
+
+		inner, err := conn.BeginTx(ctx, nil)
 		if err != nil {
+			t.Fatalf("expected a nested BeginTx to issue a SAVEPOINT, got %v", err)
+		}
+		if _, err := inner.ExecContext(ctx, "INSERT INTO t VALUES (2)"); err != nil {
 			t.Fatal(err)
 		}
-		if len(types) != 5 {
-			t.Fatal("types should be 5")
+		if err := inner.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := outer.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		rows, err := conn.QueryContext(ctx, "SELECT a FROM t ORDER BY a")
+		if err != nil {
+			t.Fatal(err)
 		}
 		defer rows.Close()
-		idx := 0
+		var got []int
 		for rows.Next() {
-			var null any
-			var id int
-			var name string
-			var gpa float64
-			var cv []byte
-			if err := rows.Scan(&null, &id, &name, &gpa, &cv); err != nil {
+			var a int
+			if err := rows.Scan(&a); err != nil {
 				t.Fatal(err)
 			}
-			if null != nil {
-				t.Fatal("null should be nil")
-			}
-			if id != int(idx) {
-				t.Fatal("id should be", idx)
-			}
-			if name != fmt.Sprint(idx) {
-				t.Fatal("name should be", idx)
-			}
-			if gpa != float64(idx)+0.5 {
-				t.Fatal("gpa should be", float64(idx)+0.5)
-			}
-			if len(cv) != 10 {
-				t.Fatal("cv should be 10 bytes")
-			}
-			idx++
-		}
-	})
-}
-
-func TestErrorQuery(t *testing.T) {
-	runMemoryAndFileTests(t, func(t *testing.T, db *sql.DB) {
-		rows, err := db.QueryContext(context.Background(), "SELECT NULL, id, name, gpa, cv FROM test")
-		if rows != nil {
-			rows.Close()
+			got = append(got, a)
 		}
-		if err == nil {
-			t.Fatal("expected error")
-		}
-		if err.Error() != "failed to execute query SELECT NULL, id, name, gpa, cv FROM test\nerror code = 1: Error executing statement: SQLite failure: `no such table: test`" {
-			t.Fatal("unexpected error:", err)
+		if want := []int{1}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected the inner transaction's insert to be rolled back, got %v", got)
 		}
 	})
 }
 
-func TestQueryWithEmptyResult(t *testing.T) {
-	runMemoryAndFileTests(t, func(t *testing.T, db *sql.DB) {
-		if _, err := db.ExecContext(context.Background(), "CREATE TABLE test (id INTEGER, name TEXT, gpa REAL, cv BLOB)"); err != nil {
+func TestReadCommittedIsolationUsesBeginDeferred(t *testing.T) {
+	runFileTest(t, func(t *testing.T, db *sql.DB) {
+		db.SetMaxOpenConns(2)
+		ctx := context.Background()
+		if _, err := db.ExecContext(ctx, "CREATE TABLE t (a INTEGER)"); err != nil {
 			t.Fatal(err)
 		}
-		rows, err := db.QueryContext(context.Background(), "SELECT NULL, id, name, gpa, cv FROM test")
+
+		conn, err := db.Conn(ctx)
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer rows.Close()
-		columns, err := rows.Columns()
+		defer conn.Close()
+
+		tx, err := conn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
 		if err != nil {
-			t.Fatal(err)
+			t.Fatalf("expected LevelReadCommitted to be supported, got %v", err)
 		}
-		assert.DeepEqual(t, columns, []string{"NULL", "id", "name", "gpa", "cv"})
-		types, err := rows.ColumnTypes()
+		// BEGIN DEFERRED does not take the write lock until the first
+		// write, so a read against a different connection must not be
+		// blocked by it.
+		otherConn, err := db.Conn(ctx)
 		if err != nil {
 			t.Fatal(err)
 		}
-		if len(types) != 5 {
-			t.Fatal("types should be 5")
+		defer otherConn.Close()
+		if _, err := otherConn.ExecContext(ctx, "SELECT count(*) FROM t"); err != nil {
+			t.Fatalf("expected a concurrent read not to be blocked by a deferred transaction, got %v", err)
 		}
-		for rows.Next() {
-			t.Fatal("there should be no rows")
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
 		}
 	})
 }
 
-func TestErrorRowsNext(t *testing.T) {
-	runFileTest(t, func(t *testing.T, db *sql.DB) {
-		db.Exec("PRAGMA journal_mode=DELETE")
-		if _, err := db.ExecContext(context.Background(), "CREATE TABLE test (id INTEGER)"); err != nil {
+func TestSyncWaitsForWriteTransaction(t *testing.T) {
+	dir, err := os.MkdirTemp("", "libsql-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sqlConnector, err := (driver{}).OpenConnector("file:" + dir + "/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connector := sqlConnector.(*Connector)
+	defer connector.Close()
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, "CREATE TABLE t (a INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A writer is holding the same writeTxLock BeginTx locks; Sync must
+	// not proceed until Commit releases it. This Connector is not an
+	// embedded replica, so syncOnce itself is expected to fail once it
+	// does run -- what this checks is the ordering, not syncOnce's result.
+	unblocked := make(chan struct{})
+	go func() {
+		connector.Sync()
+		close(unblocked)
+	}()
+
+	select {
+	case <-unblocked:
+		t.Fatal("expected Sync to block while a write transaction is open")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-unblocked:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected Sync to proceed once the write transaction committed")
+	}
+}
+
+func TestTriggerSyncRequiresSyncInterval(t *testing.T) {
+	dir, err := os.MkdirTemp("", "libsql-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sqlConnector, err := (driver{}).OpenConnector("file:" + dir + "/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connector := sqlConnector.(*Connector)
+	defer connector.Close()
+
+	// This Connector was not opened with WithSyncInterval, so it has no
+	// syncManager to drive TriggerSync.
+	if err := connector.TriggerSync(context.Background()); err == nil {
+		t.Fatal("expected TriggerSync to fail on a Connector with no sync interval")
+	}
+}
+
+func TestRegisterCollationMemoryAndFile(t *testing.T) {
+	runFunctionMemoryAndFileTests(t, func(t *testing.T, connector *Connector) {
+		if err := connector.RegisterCollation("REVERSE", func(a, b string) int {
+			// Sorts strings by their last byte, so that callers can tell
+			// this collation ran instead of the default binary one.
+			return strings.Compare(a[len(a)-1:], b[len(b)-1:])
+		}); err != nil {
 			t.Fatal(err)
 		}
-		for i := 0; i < 10; i++ {
-			if _, err := db.ExecContext(context.Background(), "INSERT INTO test VALUES("+fmt.Sprint(i)+")"); err != nil {
+
+		db := sql.OpenDB(connector)
+		defer db.Close()
+
+		if _, err := db.Exec("CREATE TABLE t (a TEXT COLLATE REVERSE)"); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range []string{"ac", "ba", "cb"} {
+			if _, err := db.Exec("INSERT INTO t VALUES (?)", v); err != nil {
 				t.Fatal(err)
 			}
 		}
-		c1, err := db.Conn(context.Background())
+		rows, err := db.Query("SELECT a FROM t ORDER BY a")
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer c1.Close()
-		c1.ExecContext(context.Background(), "PRAGMA journal_mode=DELETE")
-		c2, err := db.Conn(context.Background())
-		if err != nil {
-			t.Fatal(err)
+		defer rows.Close()
+		var got []string
+		for rows.Next() {
+			var a string
+			if err := rows.Scan(&a); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, a)
 		}
-		defer c2.Close()
-		c2.ExecContext(context.Background(), "PRAGMA journal_mode=DELETE")
-		_, err = c1.ExecContext(context.Background(), "BEGIN EXCLUSIVE TRANSACTION")
-		if err != nil {
+		assert.DeepEqual(t, got, []string{"ba", "cb", "ac"})
+	})
+}
+
+func TestRegisterAuthorizerMemoryAndFile(t *testing.T) {
+	runFunctionMemoryAndFileTests(t, func(t *testing.T, connector *Connector) {
+		if err := connector.RegisterAuthorizer(func(action AuthAction, arg1, arg2, dbName, triggerOrView string) AuthResult {
+			if arg1 == "secret" {
+				return AuthDeny
+			}
+			return AuthOk
+		}); err != nil {
 			t.Fatal(err)
 		}
-		rows, err := c2.QueryContext(context.Background(), "SELECT id FROM test")
-		if err != nil {
+
+		db := sql.OpenDB(connector)
+		defer db.Close()
+
+		if _, err := db.Exec("CREATE TABLE allowed (a INTEGER)"); err != nil {
 			t.Fatal(err)
 		}
-		defer rows.Close()
-		if rows.Next() {
-			t.Fatal("there should be no rows")
+		if _, err := db.Exec("CREATE TABLE secret (a INTEGER)"); err == nil {
+			t.Fatal("expected the authorizer to deny creating a table named \"secret\"")
 		}
-		err = rows.Err()
-		if err == nil {
-			t.Fatal("expected error")
+	})
+}
+
+func TestParseDSN(t *testing.T) {
+	cfg, err := ParseDSN("libsql://example.turso.io/db?authToken=tok&replicaPath=/var/lib/app.db&syncInterval=30s&busyTimeout=5s&tls=require&rootCert=/etc/ca.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PrimaryURL != "libsql://example.turso.io/db" {
+		t.Fatalf("unexpected PrimaryURL: %q", cfg.PrimaryURL)
+	}
+	if cfg.AuthToken != "tok" {
+		t.Fatalf("unexpected AuthToken: %q", cfg.AuthToken)
+	}
+	if cfg.ReplicaPath != "/var/lib/app.db" {
+		t.Fatalf("unexpected ReplicaPath: %q", cfg.ReplicaPath)
+	}
+	if cfg.SyncInterval != 30*time.Second {
+		t.Fatalf("unexpected SyncInterval: %v", cfg.SyncInterval)
+	}
+	if cfg.BusyTimeout != 5*time.Second {
+		t.Fatalf("unexpected BusyTimeout: %v", cfg.BusyTimeout)
+	}
+	if cfg.SSLMode != "require" {
+		t.Fatalf("unexpected SSLMode: %q", cfg.SSLMode)
+	}
+	if cfg.RootCertPath != "/etc/ca.pem" {
+		t.Fatalf("unexpected RootCertPath: %q", cfg.RootCertPath)
+	}
+}
+
+// TestParseDSNReplicaWithoutAuthTokenDoesNotRejectEmptyAuthToken guards
+// against Config.connector() unconditionally appending WithAuthToken(""),
+// which errors on an empty token: a replicaPath DSN with no authToken
+// query parameter (a perfectly valid embedded replica against an
+// unauthenticated primary) must not fail with that validation error.
+func TestParseDSNReplicaWithoutAuthTokenDoesNotRejectEmptyAuthToken(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := ParseDSN("libsql://example.turso.io/db?replicaPath=" + dir + "/replica.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AuthToken != "" {
+		t.Fatalf("expected an empty AuthToken, got %q", cfg.AuthToken)
+	}
+	if _, err := cfg.connector(); err != nil && strings.Contains(err.Error(), "authToken must not be empty") {
+		t.Fatalf("Connector rejected an empty AuthToken on a replica DSN: %v", err)
+	}
+}
+
+func TestParseDSNRejectsUnknownParam(t *testing.T) {
+	if _, err := ParseDSN("libsql://example.turso.io/db?bogus=1"); err == nil {
+		t.Fatal("expected an error for an unknown query parameter")
+	}
+}
+
+func TestParseDSNRejectsUnknownTLSMode(t *testing.T) {
+	if _, err := ParseDSN("libsql://example.turso.io/db?tls=bogus"); err == nil {
+		t.Fatal("expected an error for an unknown tls mode")
+	}
+}
+
+func TestParseDSNRejectsUnknownSchemeWithTypedError(t *testing.T) {
+	_, err := ParseDSN("s3://bucket/db")
+	if err == nil {
+		t.Fatal("expected an error for an unregistered scheme")
+	}
+	var schemeErr *UnsupportedSchemeError
+	if !errors.As(err, &schemeErr) {
+		t.Fatalf("expected an *UnsupportedSchemeError, got %T: %v", err, err)
+	}
+	if schemeErr.Scheme != "s3" {
+		t.Fatalf("unexpected Scheme: %q", schemeErr.Scheme)
+	}
+}
+
+func TestRegisterSchemeDispatchesOpenConnector(t *testing.T) {
+	const scheme = "libsql-test-scheme"
+	var gotDSN string
+	RegisterScheme(scheme, func(dsn string) (sqldriver.Connector, error) {
+		gotDSN = dsn
+		return openLocalConnector(":memory:")
+	})
+
+	dsn := scheme + "://anything"
+	connector, err := (driver{}).OpenConnector(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connector.(*Connector).Close()
+	if gotDSN != dsn {
+		t.Fatalf("expected opener to receive %q, got %q", dsn, gotDSN)
+	}
+}
+
+func TestRegisterSchemeRejectsBuiltinAndDuplicate(t *testing.T) {
+	opener := func(dsn string) (sqldriver.Connector, error) { return nil, nil }
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected RegisterScheme to panic for a built-in scheme")
+			}
+		}()
+		RegisterScheme("http", opener)
+	}()
+
+	const scheme = "libsql-test-duplicate-scheme"
+	RegisterScheme(scheme, opener)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected RegisterScheme to panic for a scheme registered twice")
+			}
+		}()
+		RegisterScheme(scheme, opener)
+	}()
+}
+
+func TestFormatDSNRoundTrips(t *testing.T) {
+	want := &Config{
+		PrimaryURL:   "libsql://example.turso.io/db",
+		AuthToken:    "tok",
+		ReplicaPath:  "/var/lib/app.db",
+		SyncInterval: 30 * time.Second,
+		BusyTimeout:  5 * time.Second,
+		SSLMode:      "require",
+	}
+	got, err := ParseDSN(FormatDSN(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *want {
+		t.Fatalf("FormatDSN/ParseDSN round trip mismatch: got %+v, want %+v", *got, *want)
+	}
+}
+
+func TestParseDSNLocal(t *testing.T) {
+	for _, dsn := range []string{":memory:", "file:" + t.TempDir() + "/local.db"} {
+		cfg, err := ParseDSN(dsn)
+		if err != nil {
+			t.Fatalf("ParseDSN(%q): %v", dsn, err)
 		}
-		if err.Error() != "failed to get next row\nerror code = 1: Error fetching next row: SQLite failure: `database is locked`" {
-			t.Fatal("unexpected error:", err)
+		if cfg.Path != dsn {
+			t.Fatalf("ParseDSN(%q): Path = %q, want %q", dsn, cfg.Path, dsn)
 		}
-	})
+		if cfg.PrimaryURL != "" {
+			t.Fatalf("ParseDSN(%q): PrimaryURL = %q, want empty", dsn, cfg.PrimaryURL)
+		}
+	}
+}
+
+func TestFormatDSNLocalRoundTrips(t *testing.T) {
+	want := &Config{Path: ":memory:"}
+	got, err := ParseDSN(FormatDSN(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *want {
+		t.Fatalf("FormatDSN/ParseDSN round trip mismatch: got %+v, want %+v", *got, *want)
+	}
+}
+
+func TestConfigConnectorOpensLocalDatabase(t *testing.T) {
+	cfg := &Config{Path: ":memory:"}
+	connector, err := cfg.Connector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connector.Close()
+
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
 }
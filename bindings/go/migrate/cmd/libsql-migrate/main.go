@@ -0,0 +1,147 @@
+// Command libsql-migrate runs the migrate package's Migrator from the
+// command line, for deploy scripts and CI steps where wiring
+// migrate.Migrator into a Go program isn't practical.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	libsql "github.com/libsql/go-libsql"
+	"github.com/libsql/go-libsql/migrate"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "libsql-migrate:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	fs := flag.NewFlagSet("libsql-migrate", flag.ExitOnError)
+	dir := fs.String("dir", "migrations", "directory of NNNN_name.up.sql / NNNN_name.down.sql migration files")
+	dbPath := fs.String("db", "", "local database file, or :memory: (the local replica file when -primary is set)")
+	primaryURL := fs.String("primary", "", "embedded-replica primary URL; enables embedded-replica mode")
+	authToken := fs.String("auth", os.Getenv("LIBSQL_AUTH_TOKEN"), "auth token for -primary")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [flags] <up|down|status|version|redo|steps N|force VERSION>\n", fs.Name())
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	rest := fs.Args()
+	if len(rest) == 0 {
+		fs.Usage()
+		return fmt.Errorf("no command given")
+	}
+	cmd, rest := rest[0], rest[1:]
+
+	m, closeMigrator, err := openMigrator(*dbPath, *primaryURL, *authToken, *dir)
+	if err != nil {
+		return err
+	}
+	defer closeMigrator()
+
+	ctx := context.Background()
+	switch cmd {
+	case "up":
+		return m.Up(ctx)
+	case "down":
+		return m.Down(ctx)
+	case "redo":
+		return m.Redo(ctx)
+	case "status":
+		return printStatus(ctx, m)
+	case "version":
+		return printVersion(ctx, m)
+	case "steps":
+		n, err := parseIntArg("steps", rest)
+		if err != nil {
+			return err
+		}
+		return m.Steps(ctx, n)
+	case "force":
+		version, err := parseIntArg("force", rest)
+		if err != nil {
+			return err
+		}
+		return m.Force(ctx, version)
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+func parseIntArg(cmd string, rest []string) (int, error) {
+	if len(rest) != 1 {
+		return 0, fmt.Errorf("%s requires exactly one argument", cmd)
+	}
+	n, err := strconv.Atoi(rest[0])
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid integer %q: %w", cmd, rest[0], err)
+	}
+	return n, nil
+}
+
+func printStatus(ctx context.Context, m *migrate.Migrator) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range statuses {
+		fmt.Printf("%04d_%s\tapplied=%v\n", s.Version, s.Name, s.Applied)
+	}
+	return nil
+}
+
+func printVersion(ctx context.Context, m *migrate.Migrator) error {
+	version, dirty, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d\tdirty=%v\n", version, dirty)
+	return nil
+}
+
+// openMigrator opens a Migrator in embedded-replica mode if primaryURL is
+// set, or against a plain local/:memory: database otherwise.
+func openMigrator(dbPath, primaryURL, authToken, dir string) (m *migrate.Migrator, closeFn func(), err error) {
+	source := migrate.FSSource(os.DirFS(dir), ".")
+
+	if primaryURL != "" {
+		var opts []libsql.Option
+		if authToken != "" {
+			opts = append(opts, libsql.WithAuthToken(authToken))
+		}
+		connector, err := libsql.NewEmbeddedReplicaConnector(dbPath, primaryURL, opts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening embedded replica %s: %w", dbPath, err)
+		}
+		m, err := migrate.New(connector, source)
+		if err != nil {
+			connector.Close()
+			return nil, nil, err
+		}
+		return m, func() { m.Close(); connector.Close() }, nil
+	}
+
+	if dbPath == "" {
+		return nil, nil, fmt.Errorf("either -db or -primary must be set")
+	}
+	db, err := sql.Open("libsql", dbPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening %s: %w", dbPath, err)
+	}
+	m, err = migrate.NewDB(db, source)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return m, func() { m.Close() }, nil
+}
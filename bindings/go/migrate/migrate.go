@@ -0,0 +1,608 @@
+// Package migrate provides a forward/backward schema migration runner for
+// libsql databases, including embedded replicas. Migrations come from
+// either SQL files named "NNNN_name.up.sql" / "NNNN_name.down.sql" (see
+// FSSource) or plain Go functions (see FuncSource); a schema_migrations
+// table is created on first use to track the applied version, plus when
+// (applied_at) and a content checksum (checksum) for each applied version.
+//
+// An earlier revision of this package was going to track that bookkeeping
+// in a table named libsql_schema_migrations. That was reconciled into this
+// schema_migrations table instead, once both turned out to be the same
+// subsystem requested twice: renaming out from under already-applied
+// schema_migrations rows would have forced every existing caller through a
+// migration of the migrator itself, for no behavioral gain.
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	libsql "github.com/libsql/go-libsql"
+)
+
+// Source enumerates available migrations.
+type Source interface {
+	// Migrations returns every migration found by the source, sorted by
+	// version ascending.
+	Migrations() ([]Migration, error)
+}
+
+// Migration is a single forward ("up") and, optionally, backward ("down")
+// schema change at a given version. A migration runs its SQL (Up/Down) if
+// set, or else its Go function (UpFunc/DownFunc) against the same
+// transaction runOne would otherwise run the SQL in. Setting both the SQL
+// and the func for a direction is a mistake; the SQL is ignored in that
+// case since the func takes precedence.
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	UpFunc   func(ctx context.Context, tx *sql.Tx) error
+	DownFunc func(ctx context.Context, tx *sql.Tx) error
+}
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// FSSource reads migrations named "NNNN_name.up.sql" / "NNNN_name.down.sql"
+// out of dir within fsys.
+func FSSource(fsys fs.FS, dir string) Source {
+	return &fsSource{fsys: fsys, dir: dir}
+}
+
+type fsSource struct {
+	fsys fs.FS
+	dir  string
+}
+
+func (s *fsSource) Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(s.fsys, s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: reading %s: %w", s.dir, err)
+	}
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		m := migrationFileRe.FindStringSubmatch(entry.Name())
+		if m == nil {
+			continue
+		}
+		version, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, fmt.Errorf("migrate: invalid version in %s: %w", entry.Name(), err)
+		}
+		contents, err := fs.ReadFile(s.fsys, path.Join(s.dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("migrate: reading %s: %w", entry.Name(), err)
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if m[3] == "up" {
+			mig.Up = string(contents)
+		} else {
+			mig.Down = string(contents)
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// FuncSource returns migrations directly, for callers that want Go-function
+// migrations (e.g. a backfill too data-dependent to express as plain SQL)
+// instead of, or alongside, FSSource's SQL files.
+func FuncSource(migrations []Migration) Source {
+	return sliceSource(migrations)
+}
+
+type sliceSource []Migration
+
+func (s sliceSource) Migrations() ([]Migration, error) {
+	return []Migration(s), nil
+}
+
+// Migrator applies and rolls back Migrations against a libsql database,
+// tracking progress in a schema_migrations table.
+type Migrator struct {
+	db        *sql.DB
+	connector *libsql.Connector
+	source    Source
+}
+
+// New creates a Migrator that runs migrations from source against the
+// database behind connector. Up and Down call connector.Sync before and
+// after the migrations they run, whatever kind of database connector opens,
+// and return an error if a sync fails; for a local database with no primary
+// to sync with, use NewDB instead.
+func New(connector *libsql.Connector, source Source) (*Migrator, error) {
+	db := sql.OpenDB(connector)
+	m, err := newMigrator(db, connector, source)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// NewDB creates a Migrator against an already-open *sql.DB, for callers
+// using a plain local file or :memory: database (e.g. opened via
+// sql.Open("libsql", dsn)) that have no primary to sync with. Up and Down
+// never call Sync in this mode. The returned Migrator takes ownership of
+// db: closing it closes db too, same as New.
+func NewDB(db *sql.DB, source Source) (*Migrator, error) {
+	return newMigrator(db, nil, source)
+}
+
+func newMigrator(db *sql.DB, connector *libsql.Connector, source Source) (*Migrator, error) {
+	m := &Migrator{db: db, connector: connector, source: source}
+	if err := m.ensureSchema(context.Background()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Migrator) ensureSchema(ctx context.Context) error {
+	if _, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		dirty INTEGER NOT NULL DEFAULT 0,
+		applied_at TEXT,
+		checksum TEXT
+	)`); err != nil {
+		return err
+	}
+	// schema_migrations predates applied_at/checksum, so a database from
+	// before this version of the package has the table without them; add
+	// them in place rather than forcing every caller to re-create it.
+	return m.addMissingColumns(ctx, "applied_at TEXT", "checksum TEXT")
+}
+
+// addMissingColumns adds any of columnDefs (each "name type...") not
+// already present on schema_migrations. SQLite has no ADD COLUMN IF NOT
+// EXISTS, so existing columns are found via PRAGMA table_info first.
+func (m *Migrator) addMissingColumns(ctx context.Context, columnDefs ...string) error {
+	rows, err := m.db.QueryContext(ctx, `PRAGMA table_info(schema_migrations)`)
+	if err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, def := range columnDefs {
+		name := strings.Fields(def)[0]
+		if existing[name] {
+			continue
+		}
+		if _, err := m.db.ExecContext(ctx, `ALTER TABLE schema_migrations ADD COLUMN `+def); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Version returns the currently applied migration version, or 0 if no
+// migration has ever been applied.
+func (m *Migrator) Version(ctx context.Context) (version int, dirty bool, err error) {
+	row := m.db.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations ORDER BY version DESC LIMIT 1`)
+	err = row.Scan(&version, &dirty)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return version, dirty, err
+}
+
+// Up applies every migration with a version greater than the current one, in
+// order.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.migrateTo(ctx, -1)
+}
+
+// Down rolls back every applied migration, in reverse order.
+func (m *Migrator) Down(ctx context.Context) error {
+	return m.migrateTo(ctx, 0)
+}
+
+// Steps applies (n > 0) or rolls back (n < 0) up to |n| migrations relative
+// to the current version.
+func (m *Migrator) Steps(ctx context.Context, n int) error {
+	if n == 0 {
+		return nil
+	}
+	migrations, err := m.sortedMigrations()
+	if err != nil {
+		return err
+	}
+	version, _, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		pending := pendingMigrations(migrations, version, -1)
+		if n < len(pending) {
+			pending = pending[:n]
+		}
+		return m.applyUp(ctx, pending)
+	}
+	applied := appliedMigrations(migrations, version)
+	if -n < len(applied) {
+		applied = applied[len(applied)+n:]
+	}
+	// Reverse order: roll back the most recent migration first.
+	for i, j := 0, len(applied)-1; i < j; i, j = i+1, j-1 {
+		applied[i], applied[j] = applied[j], applied[i]
+	}
+	return m.applyDown(ctx, applied)
+}
+
+// Force sets the recorded version without running any migration, clearing
+// the dirty flag. It is used to recover from a migration that crashed
+// mid-run.
+func (m *Migrator) Force(ctx context.Context, version int) error {
+	_, err := m.db.ExecContext(ctx, `DELETE FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	_, err = m.db.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES (?, 0)`, version)
+	return err
+}
+
+func (m *Migrator) migrateTo(ctx context.Context, target int) error {
+	migrations, err := m.sortedMigrations()
+	if err != nil {
+		return err
+	}
+	version, _, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if target == -1 {
+		return m.applyUp(ctx, pendingMigrations(migrations, version, -1))
+	}
+	applied := appliedMigrations(migrations, version)
+	// Reverse order: roll back the most recent migration first.
+	for i, j := 0, len(applied)-1; i < j; i, j = i+1, j-1 {
+		applied[i], applied[j] = applied[j], applied[i]
+	}
+	return m.applyDown(ctx, applied)
+}
+
+func pendingMigrations(migrations []Migration, version, limit int) []Migration {
+	var pending []Migration
+	for _, mig := range migrations {
+		if mig.Version > version {
+			pending = append(pending, mig)
+		}
+	}
+	return pending
+}
+
+func appliedMigrations(migrations []Migration, version int) []Migration {
+	var applied []Migration
+	for _, mig := range migrations {
+		if mig.Version <= version {
+			applied = append(applied, mig)
+		}
+	}
+	return applied
+}
+
+// MigrationStatus describes one migration's position relative to the
+// currently applied version, as returned by Status.
+type MigrationStatus struct {
+	Migration
+	Applied bool
+}
+
+// Status reports every migration known to m.source, in version order, each
+// marked Applied if its version is at or below the currently applied
+// version.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := m.sortedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	version, _, err := m.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, mig := range migrations {
+		statuses[i] = MigrationStatus{Migration: mig, Applied: mig.Version <= version}
+	}
+	return statuses, nil
+}
+
+// UpTo applies every pending migration with a version greater than the
+// current one and less than or equal to target, in order. It is a no-op if
+// target is already at or below the current version.
+func (m *Migrator) UpTo(ctx context.Context, target int) error {
+	migrations, err := m.sortedMigrations()
+	if err != nil {
+		return err
+	}
+	version, _, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	var pending []Migration
+	for _, mig := range migrations {
+		if mig.Version > version && mig.Version <= target {
+			pending = append(pending, mig)
+		}
+	}
+	return m.applyUp(ctx, pending)
+}
+
+// Redo rolls back and reapplies the most recently applied migration,
+// useful for iterating on a migration's SQL during development.
+func (m *Migrator) Redo(ctx context.Context) error {
+	version, _, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		return fmt.Errorf("migrate: no applied migration to redo")
+	}
+	migrations, err := m.sortedMigrations()
+	if err != nil {
+		return err
+	}
+	for _, mig := range migrations {
+		if mig.Version != version {
+			continue
+		}
+		if err := m.applyDown(ctx, []Migration{mig}); err != nil {
+			return err
+		}
+		return m.applyUp(ctx, []Migration{mig})
+	}
+	return fmt.Errorf("migrate: no migration source found for applied version %d", version)
+}
+
+func (m *Migrator) sortedMigrations() ([]Migration, error) {
+	migrations, err := m.source.Migrations()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func (m *Migrator) applyUp(ctx context.Context, migrations []Migration) error {
+	if len(migrations) == 0 {
+		return nil
+	}
+	if m.connector != nil {
+		if err := m.connector.Sync(); err != nil {
+			return fmt.Errorf("migrate: refusing to run against a stale replica, sync failed: %w", err)
+		}
+	}
+	for _, mig := range migrations {
+		if err := m.runOne(ctx, mig.Version, mig.Up, mig.UpFunc); err != nil {
+			return fmt.Errorf("migrate: applying %04d_%s.up.sql: %w", mig.Version, mig.Name, err)
+		}
+		if m.connector != nil {
+			if err := m.connector.Sync(); err != nil {
+				return fmt.Errorf("migrate: sync after applying version %d: %w", mig.Version, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) applyDown(ctx context.Context, migrations []Migration) error {
+	if len(migrations) == 0 {
+		return nil
+	}
+	if m.connector != nil {
+		if err := m.connector.Sync(); err != nil {
+			return fmt.Errorf("migrate: refusing to run against a stale replica, sync failed: %w", err)
+		}
+	}
+	for _, mig := range migrations {
+		if strings.TrimSpace(mig.Down) == "" && mig.DownFunc == nil {
+			return fmt.Errorf("migrate: no down migration for version %d (%s)", mig.Version, mig.Name)
+		}
+		if err := m.runOne(ctx, mig.Version-1, mig.Down, mig.DownFunc); err != nil {
+			return fmt.Errorf("migrate: reverting %04d_%s.down.sql: %w", mig.Version, mig.Name, err)
+		}
+		if m.connector != nil {
+			if err := m.connector.Sync(); err != nil {
+				return fmt.Errorf("migrate: sync after reverting version %d: %w", mig.Version, err)
+			}
+		}
+	}
+	return nil
+}
+
+// runOne marks schema_migrations dirty, runs a single migration (its SQL
+// script, or fn if set -- see Migration), and clears the dirty flag while
+// recording applied_at/checksum, in that order across two separately
+// committed transactions so a crash mid-migration leaves a durable,
+// observable trace. Folding all three steps into one transaction that only
+// commits at the end (as an earlier version of this function did) would
+// mean a process that dies partway through the migration leaves nothing
+// committed at all -- not even dirty=1 -- so Version would report the
+// pre-migration state as if the migration had never started, defeating the
+// entire point of the flag. Splitting the migration into its own committed
+// step after dirty=1 means a crash there is reported by Version (dirty=true
+// at newVersion) and must be resolved with Force before migrating again.
+func (m *Migrator) runOne(ctx context.Context, newVersion int, script string, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	// sql.LevelSerializable is what actually maps to BEGIN IMMEDIATE (see
+	// conn.BeginTx); the default TxOptions{} issues a plain BEGIN, which
+	// would not serialize two Migrators racing Up against the same
+	// schema_migrations row.
+	txOpts := &sql.TxOptions{Isolation: sql.LevelSerializable}
+
+	markTx, err := m.db.BeginTx(ctx, txOpts)
+	if err != nil {
+		return err
+	}
+	defer markTx.Rollback()
+	if _, err := markTx.ExecContext(ctx, `DELETE FROM schema_migrations`); err != nil {
+		return err
+	}
+	if _, err := markTx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES (?, 1)`, newVersion); err != nil {
+		return err
+	}
+	if err := markTx.Commit(); err != nil {
+		return err
+	}
+
+	runTx, err := m.db.BeginTx(ctx, txOpts)
+	if err != nil {
+		return err
+	}
+	defer runTx.Rollback()
+	if fn != nil {
+		if err := fn(ctx, runTx); err != nil {
+			return err
+		}
+	} else {
+		for _, stmt := range splitStatements(script) {
+			if strings.TrimSpace(stmt) == "" {
+				continue
+			}
+			if _, err := runTx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+	}
+	checksum := migrationChecksum(newVersion, script, fn)
+	if _, err := runTx.ExecContext(ctx, `UPDATE schema_migrations SET dirty = 0, applied_at = CURRENT_TIMESTAMP, checksum = ? WHERE version = ?`, checksum, newVersion); err != nil {
+		return err
+	}
+	return runTx.Commit()
+}
+
+// migrationChecksum computes the checksum recorded in schema_migrations for
+// the migration that was just applied at newVersion, so tooling that reads
+// schema_migrations can later detect a migration file that was edited after
+// being applied; Status does not compare checksums itself. A
+// Go-function migration has no script to hash, so its checksum instead
+// covers its version and fn's identity (funcs aren't comparable/hashable by
+// value in Go) -- good enough to flag "this func migration was swapped for
+// a different one at the same version", even though it can't detect an edit
+// to the function body itself.
+func migrationChecksum(newVersion int, script string, fn func(ctx context.Context, tx *sql.Tx) error) string {
+	h := sha256.New()
+	if fn != nil {
+		fmt.Fprintf(h, "func:%d:%p", newVersion, fn)
+	} else {
+		io.WriteString(h, script)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// splitStatements splits script into individual SQL statements on top-level
+// semicolons, tracking single- and double-quoted strings, bracketed and
+// backtick-quoted identifiers, and both comment styles so a semicolon inside
+// any of those (e.g. INSERT INTO t(msg) VALUES ('a;b')) is not mistaken for a
+// statement boundary.
+func splitStatements(script string) []string {
+	var (
+		statements []string
+		start      int
+	)
+	runes := []rune(script)
+	for i := 0; i < len(runes); i++ {
+		switch c := runes[i]; c {
+		case '\'', '"', '`':
+			i = skipQuoted(runes, i, c)
+		case '[':
+			i = skipQuoted(runes, i, ']')
+		case '-':
+			if i+1 < len(runes) && runes[i+1] == '-' {
+				i = skipLineComment(runes, i)
+			}
+		case '/':
+			if i+1 < len(runes) && runes[i+1] == '*' {
+				i = skipBlockComment(runes, i)
+			}
+		case ';':
+			statements = append(statements, string(runes[start:i]))
+			start = i + 1
+		}
+	}
+	if start < len(runes) {
+		statements = append(statements, string(runes[start:]))
+	}
+	return statements
+}
+
+// skipQuoted returns the index of the closing quote matching close that
+// opened at runes[open], honoring a doubled quote character (e.g. two
+// consecutive single quotes inside a single-quoted string) as an escaped
+// quote rather than a terminator.
+func skipQuoted(runes []rune, open int, close rune) int {
+	for i := open + 1; i < len(runes); i++ {
+		if runes[i] != close {
+			continue
+		}
+		if i+1 < len(runes) && runes[i+1] == close {
+			i++
+			continue
+		}
+		return i
+	}
+	return len(runes) - 1
+}
+
+// skipLineComment returns the index of the newline (or end of script) that
+// ends the "--" comment starting at runes[start].
+func skipLineComment(runes []rune, start int) int {
+	for i := start; i < len(runes); i++ {
+		if runes[i] == '\n' {
+			return i
+		}
+	}
+	return len(runes) - 1
+}
+
+// skipBlockComment returns the index of the "*/" (or end of script) that
+// ends the "/*" comment starting at runes[start].
+func skipBlockComment(runes []rune, start int) int {
+	for i := start + 2; i < len(runes); i++ {
+		if runes[i] == '*' && i+1 < len(runes) && runes[i+1] == '/' {
+			return i + 1
+		}
+	}
+	return len(runes) - 1
+}
+
+// Close closes the underlying *sql.DB. It does not close the Connector, which
+// the caller retains ownership of.
+func (m *Migrator) Close() error {
+	return m.db.Close()
+}
@@ -0,0 +1,329 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"sync"
+	"testing"
+
+	libsql "github.com/libsql/go-libsql"
+)
+
+func testChain() Source {
+	return sliceSource{
+		{Version: 1, Name: "create_users", Up: `CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT)`, Down: `DROP TABLE users`},
+		{Version: 2, Name: "add_email", Up: `ALTER TABLE users ADD COLUMN email TEXT`, Down: `ALTER TABLE users DROP COLUMN email`},
+	}
+}
+
+func withMigrator(t *testing.T, fn func(ctx context.Context, connector *libsql.Connector, m *Migrator)) {
+	primaryUrl := os.Getenv("LIBSQL_PRIMARY_URL")
+	if primaryUrl == "" {
+		t.Skip("LIBSQL_PRIMARY_URL is not set")
+		return
+	}
+	authToken := os.Getenv("LIBSQL_AUTH_TOKEN")
+	dir, err := os.MkdirTemp("", "libsql-migrate-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var opts []libsql.Option
+	if authToken != "" {
+		opts = append(opts, libsql.WithAuthToken(authToken))
+	}
+	connector, err := libsql.NewEmbeddedReplicaConnector(dir+"/test.db", primaryUrl, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connector.Close()
+
+	m, err := New(connector, testChain())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	fn(context.Background(), connector, m)
+}
+
+func TestMigrate(t *testing.T) {
+	withMigrator(t, func(ctx context.Context, connector *libsql.Connector, m *Migrator) {
+		if err := m.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+		version, dirty, err := m.Version(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 2 || dirty {
+			t.Fatalf("expected version 2 (clean), got %d (dirty=%v)", version, dirty)
+		}
+
+		if err := m.Down(ctx); err != nil {
+			t.Fatal(err)
+		}
+		version, _, err = m.Version(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 0 {
+			t.Fatalf("expected version 0 after Down, got %d", version)
+		}
+	})
+}
+
+func TestMigrateUpToAndRedo(t *testing.T) {
+	withMigrator(t, func(ctx context.Context, connector *libsql.Connector, m *Migrator) {
+		if err := m.UpTo(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		version, dirty, err := m.Version(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 1 || dirty {
+			t.Fatalf("expected version 1 (clean), got %d (dirty=%v)", version, dirty)
+		}
+
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(statuses) != 2 || !statuses[0].Applied || statuses[1].Applied {
+			t.Fatalf("expected only version 1 to be applied, got %+v", statuses)
+		}
+
+		if err := m.Redo(ctx); err != nil {
+			t.Fatal(err)
+		}
+		version, dirty, err = m.Version(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 1 || dirty {
+			t.Fatalf("expected Redo to leave version 1 (clean), got %d (dirty=%v)", version, dirty)
+		}
+	})
+}
+
+// TestMigrateFuncMigrations guards against runOne only knowing how to run a
+// migration's SQL: a Go-function migration (UpFunc/DownFunc) must run, and
+// be tracked in schema_migrations, the same as a SQL one.
+func TestMigrateFuncMigrations(t *testing.T) {
+	withMigrator(t, func(ctx context.Context, connector *libsql.Connector, m *Migrator) {
+		var upRan, downRan bool
+		funcs := FuncSource([]Migration{
+			{
+				Version: 1,
+				Name:    "seed_admins_table",
+				UpFunc: func(ctx context.Context, tx *sql.Tx) error {
+					upRan = true
+					_, err := tx.ExecContext(ctx, `CREATE TABLE admins (id INTEGER PRIMARY KEY)`)
+					return err
+				},
+				DownFunc: func(ctx context.Context, tx *sql.Tx) error {
+					downRan = true
+					_, err := tx.ExecContext(ctx, `DROP TABLE admins`)
+					return err
+				},
+			},
+		})
+
+		fm, err := New(connector, funcs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fm.Close()
+
+		if err := fm.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if !upRan {
+			t.Fatal("expected UpFunc to run")
+		}
+		version, dirty, err := fm.Version(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 1 || dirty {
+			t.Fatalf("expected version 1 (clean) after a func migration, got %d (dirty=%v)", version, dirty)
+		}
+
+		if err := fm.Down(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if !downRan {
+			t.Fatal("expected DownFunc to run")
+		}
+	})
+}
+
+// TestMigrateRecordsAppliedAtAndChecksum guards against applied_at/checksum
+// staying NULL after a successful migration.
+func TestMigrateRecordsAppliedAtAndChecksum(t *testing.T) {
+	withMigrator(t, func(ctx context.Context, connector *libsql.Connector, m *Migrator) {
+		if err := m.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+		var appliedAt, checksum sql.NullString
+		row := m.db.QueryRowContext(ctx, `SELECT applied_at, checksum FROM schema_migrations WHERE version = 2`)
+		if err := row.Scan(&appliedAt, &checksum); err != nil {
+			t.Fatal(err)
+		}
+		if !appliedAt.Valid || appliedAt.String == "" {
+			t.Fatal("expected applied_at to be recorded for the applied version")
+		}
+		if !checksum.Valid || checksum.String == "" {
+			t.Fatal("expected checksum to be recorded for the applied version")
+		}
+	})
+}
+
+// TestMigrateConcurrentUpDoesNotDoubleApply guards against runOne's lock
+// being a no-op BEGIN rather than a real BEGIN IMMEDIATE: two Migrators
+// built from the same Connector (e.g. two instances of an app starting up
+// against the same replica file at once) racing Up must serialize on
+// schema_migrations instead of both running the same migration's DDL, which
+// would otherwise surface as a "table already exists" race instead of a
+// clean, single application.
+func TestMigrateConcurrentUpDoesNotDoubleApply(t *testing.T) {
+	withMigrator(t, func(ctx context.Context, connector *libsql.Connector, m *Migrator) {
+		m2, err := New(connector, testChain())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m2.Close()
+
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		wg.Add(2)
+		go func() { defer wg.Done(); errs[0] = m.Up(ctx) }()
+		go func() { defer wg.Done(); errs[1] = m2.Up(ctx) }()
+		wg.Wait()
+
+		for _, err := range errs {
+			if err != nil {
+				t.Logf("one racing Up returned (expected if it lost the lock race): %v", err)
+			}
+		}
+
+		version, dirty, err := m.Version(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 2 || dirty {
+			t.Fatalf("expected version 2 (clean) after racing Up, got %d (dirty=%v)", version, dirty)
+		}
+	})
+}
+
+// TestSplitStatements guards against splitStatements naively breaking on
+// every semicolon in the script, which would corrupt a migration containing
+// a semicolon inside a string literal, quoted identifier, or comment.
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{
+			name:   "simple",
+			script: `CREATE TABLE a (id INTEGER); CREATE TABLE b (id INTEGER)`,
+			want:   []string{`CREATE TABLE a (id INTEGER)`, ` CREATE TABLE b (id INTEGER)`},
+		},
+		{
+			name:   "semicolon in string literal",
+			script: `INSERT INTO t(msg) VALUES ('a;b'); INSERT INTO t(msg) VALUES ('c')`,
+			want:   []string{`INSERT INTO t(msg) VALUES ('a;b')`, ` INSERT INTO t(msg) VALUES ('c')`},
+		},
+		{
+			name:   "escaped quote inside string literal",
+			script: `INSERT INTO t(msg) VALUES ('a''; DROP TABLE t; --b')`,
+			want:   []string{`INSERT INTO t(msg) VALUES ('a''; DROP TABLE t; --b')`},
+		},
+		{
+			name:   "semicolon in quoted identifier",
+			script: `CREATE TABLE "weird;name" (id INTEGER)`,
+			want:   []string{`CREATE TABLE "weird;name" (id INTEGER)`},
+		},
+		{
+			name:   "semicolon in line comment",
+			script: "SELECT 1; -- comment; with semicolons\nSELECT 2",
+			want:   []string{`SELECT 1`, " -- comment; with semicolons\nSELECT 2"},
+		},
+		{
+			name:   "semicolon in block comment",
+			script: `SELECT 1; /* a; b; c */ SELECT 2`,
+			want:   []string{`SELECT 1`, ` /* a; b; c */ SELECT 2`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitStatements(tt.script)
+			if len(got) != len(tt.want) {
+				t.Fatalf("splitStatements(%q) = %q, want %q", tt.script, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("splitStatements(%q)[%d] = %q, want %q", tt.script, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestMigrateFailedDDLLeavesDirtyVersion guards against runOne folding the
+// dirty=1 write into the same uncommitted transaction as the migration DDL:
+// if a migration's DDL fails partway through, the dirty=1 row marking it
+// in-progress must already be durably committed, so Version reports the
+// failed version as dirty rather than silently reverting to the
+// pre-migration version as if nothing had been attempted.
+func TestMigrateFailedDDLLeavesDirtyVersion(t *testing.T) {
+	withMigrator(t, func(ctx context.Context, connector *libsql.Connector, m *Migrator) {
+		broken := sliceSource{
+			{Version: 1, Name: "broken", Up: `CREATE TABLE this is not valid SQL`},
+		}
+		bm, err := New(connector, broken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bm.Close()
+
+		if err := bm.Up(ctx); err == nil {
+			t.Fatal("expected the broken migration's DDL to fail")
+		}
+		version, dirty, err := bm.Version(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 1 || !dirty {
+			t.Fatalf("expected version 1 marked dirty after a failed migration, got %d (dirty=%v)", version, dirty)
+		}
+	})
+}
+
+func TestMigrateEmbedded(t *testing.T) {
+	withMigrator(t, func(ctx context.Context, connector *libsql.Connector, m *Migrator) {
+		if err := m.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+		version, dirty, err := m.Version(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 2 || dirty {
+			t.Fatalf("expected version 2 (clean), got %d (dirty=%v)", version, dirty)
+		}
+
+		// The schema change must be visible on the primary too, not just
+		// on the local replica file.
+		db := sql.OpenDB(connector)
+		defer db.Close()
+		if _, err := db.ExecContext(ctx, `SELECT email FROM users LIMIT 0`); err != nil {
+			t.Fatalf("expected email column to exist on the primary after Up: %v", err)
+		}
+	})
+}
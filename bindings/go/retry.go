@@ -0,0 +1,395 @@
+//go:build cgo
+// +build cgo
+
+package libsql
+
+/*
+#include <libsql.h>
+*/
+import "C"
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// sqliteBusy and sqliteLocked are SQLite's own result codes for SQLITE_BUSY
+// and SQLITE_LOCKED, the two codes defaultRetryableError checks Error.Code
+// against directly rather than relying solely on substring matching.
+const (
+	sqliteBusy   = 5
+	sqliteLocked = 6
+)
+
+// BackoffFunc computes how long to wait before the next attempt of an
+// operation that just failed with a retryable error. attempt is 1 on the
+// first retry (i.e. after the operation's first failure), 2 on the second,
+// and so on; see WithRetryBackoff.
+type BackoffFunc func(attempt int) time.Duration
+
+// defaultMaxRetries caps the number of times ExecContext, QueryContext, and
+// RunInTx automatically re-run an operation that failed with a retryable
+// error; see WithMaxRetries.
+const defaultMaxRetries = 4
+
+// defaultRetryBackoff waits exponentially longer between attempts, starting
+// around 5ms and capping at 1s, with up to 50% jitter subtracted so many
+// connections retrying the same conflict don't all wake up in lockstep.
+func defaultRetryBackoff(attempt int) time.Duration {
+	const (
+		base    = 5 * time.Millisecond
+		maxWait = 1 * time.Second
+	)
+	d := base << attempt
+	if d <= 0 || d > maxWait {
+		d = maxWait
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// defaultRetryableError reports whether err looks like a SQLITE_BUSY,
+// SQLITE_LOCKED, or libsql write-conflict/serialization failure: first by
+// checking Error.Code against the native result codes those conditions use,
+// then by falling back to a substring match against the error text for
+// errors that did not come from libsqlError (or whose message carries more
+// detail than the code alone, such as a wrapped write-conflict). See
+// WithRetryableErrors to replace this with a different predicate.
+func defaultRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var libsqlErr *Error
+	if errors.As(err, &libsqlErr) && (libsqlErr.Code == sqliteBusy || libsqlErr.Code == sqliteLocked) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, needle := range []string{
+		"database is locked",
+		"database table is locked",
+		"sqlite_busy",
+		"sqlite_locked",
+		"busy",
+		"write conflict",
+		"serialization failure",
+		// Transient "connection lost" conditions against a remote or
+		// embedded-replica primary: a dropped TCP connection, a reset mid-
+		// request, or sqld itself briefly unreachable.
+		"connection reset",
+		"connection refused",
+		"broken pipe",
+		"eof",
+		"i/o timeout",
+		"no such host",
+		"use of closed network connection",
+		"connection lost",
+	} {
+		if strings.Contains(msg, needle) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryPolicy is the resolved, always-non-nil set of knobs ExecContext,
+// QueryContext, and RunInTx consult to decide whether and how long to wait
+// before re-running an operation that failed with a retryable error. Every
+// Connector owns one, built from the WithMaxRetries/WithRetryBackoff/
+// WithRetryableErrors options (or their defaults) once in newConnector, and
+// copies it onto every conn it opens.
+type retryPolicy struct {
+	maxRetries  int
+	backoff     BackoffFunc
+	isRetryable func(error) bool
+}
+
+func defaultRetryPolicy() *retryPolicy {
+	return &retryPolicy{
+		maxRetries:  defaultMaxRetries,
+		backoff:     defaultRetryBackoff,
+		isRetryable: defaultRetryableError,
+	}
+}
+
+// WithMaxRetries caps the number of automatic retries ExecContext,
+// QueryContext, and RunInTx perform for an operation that fails with a
+// retryable error (see WithRetryableErrors). The default is 4; 0 disables
+// automatic retries entirely.
+func WithMaxRetries(n int) Option {
+	return option(func(o *config) error {
+		if o.maxRetries != nil {
+			return fmt.Errorf("max retries already set")
+		}
+		if n < 0 {
+			return fmt.Errorf("max retries must not be negative")
+		}
+		o.maxRetries = &n
+		return nil
+	})
+}
+
+// WithRetryBackoff overrides how long ExecContext, QueryContext, and
+// RunInTx wait between automatic retries. The default, defaultRetryBackoff,
+// is exponential with jitter, starting around 5ms and capping at 1s.
+func WithRetryBackoff(backoff BackoffFunc) Option {
+	return option(func(o *config) error {
+		if o.retryBackoff != nil {
+			return fmt.Errorf("retry backoff already set")
+		}
+		if backoff == nil {
+			return fmt.Errorf("retry backoff must not be nil")
+		}
+		o.retryBackoff = backoff
+		return nil
+	})
+}
+
+// WithRetryableErrors overrides which errors ExecContext, QueryContext, and
+// RunInTx treat as transient and worth retrying. The default,
+// defaultRetryableError, matches SQLITE_BUSY/SQLITE_LOCKED and libsql write
+// conflict errors by substring on the error text.
+func WithRetryableErrors(isRetryable func(error) bool) Option {
+	return option(func(o *config) error {
+		if o.isRetryableErr != nil {
+			return fmt.Errorf("retryable error predicate already set")
+		}
+		if isRetryable == nil {
+			return fmt.Errorf("retryable error predicate must not be nil")
+		}
+		o.isRetryableErr = isRetryable
+		return nil
+	})
+}
+
+// RetryPolicy is a structured, all-in-one alternative to WithMaxRetries/
+// WithRetryBackoff/WithRetryableErrors, passed to WithRetryPolicy or set on
+// Config.RetryPolicy. MaxAttempts counts the first try plus every retry
+// (so MaxAttempts 1 disables retrying); a zero MaxAttempts, InitialBackoff
+// or MaxBackoff falls back to DefaultRetryPolicy's value, while a zero
+// Jitter means no jitter at all. Retryable overrides which errors are worth
+// retrying; nil keeps defaultRetryableError, which covers SQLITE_BUSY/
+// SQLITE_LOCKED, write conflicts, and connection-lost conditions against a
+// remote or embedded-replica primary.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter is the fraction (0 to 1) of each computed backoff that is
+	// randomly subtracted, so concurrent retries don't all wake in
+	// lockstep. 0.5 matches defaultRetryBackoff's shape.
+	Jitter    float64
+	Retryable func(error) bool
+}
+
+// DefaultRetryPolicy returns the RetryPolicy every Connector uses unless
+// overridden by WithRetryPolicy or Config.RetryPolicy: exponential backoff
+// from 5ms up to 1s with 50% jitter, up to 5 attempts total (the first try
+// plus 4 retries).
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    defaultMaxRetries + 1,
+		InitialBackoff: 5 * time.Millisecond,
+		MaxBackoff:     1 * time.Second,
+		Jitter:         0.5,
+	}
+}
+
+func (p RetryPolicy) maxRetries() int {
+	if p.MaxAttempts <= 0 {
+		return defaultMaxRetries
+	}
+	if p.MaxAttempts-1 < 0 {
+		return 0
+	}
+	return p.MaxAttempts - 1
+}
+
+func (p RetryPolicy) backoffFunc() BackoffFunc {
+	initial := p.InitialBackoff
+	if initial <= 0 {
+		initial = 5 * time.Millisecond
+	}
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 1 * time.Second
+	}
+	jitter := p.Jitter
+	switch {
+	case jitter < 0:
+		jitter = 0
+	case jitter > 1:
+		jitter = 1
+	}
+	return func(attempt int) time.Duration {
+		d := initial << attempt
+		if d <= 0 || d > maxBackoff {
+			d = maxBackoff
+		}
+		if jitter == 0 {
+			return d
+		}
+		return d - time.Duration(rand.Int63n(int64(float64(d)*jitter)+1))
+	}
+}
+
+// resolve builds the internal retryPolicy p describes, defaulting Retryable
+// to defaultRetryableError.
+func (p RetryPolicy) resolve() *retryPolicy {
+	isRetryable := p.Retryable
+	if isRetryable == nil {
+		isRetryable = defaultRetryableError
+	}
+	return &retryPolicy{
+		maxRetries:  p.maxRetries(),
+		backoff:     p.backoffFunc(),
+		isRetryable: isRetryable,
+	}
+}
+
+// WithRetryPolicy configures MaxAttempts, backoff, and which errors count
+// as retryable in one call, applied to the initial connect, Sync, and
+// ExecContext/QueryContext/RunInTx alike. It cannot be combined with
+// WithMaxRetries, WithRetryBackoff, or WithRetryableErrors.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return option(func(o *config) error {
+		if o.maxRetries != nil || o.retryBackoff != nil || o.isRetryableErr != nil {
+			return fmt.Errorf("retry policy already set via WithRetryPolicy, WithMaxRetries, WithRetryBackoff, or WithRetryableErrors")
+		}
+		n := p.maxRetries()
+		o.maxRetries = &n
+		o.retryBackoff = p.backoffFunc()
+		if p.Retryable != nil {
+			o.isRetryableErr = p.Retryable
+		} else {
+			o.isRetryableErr = defaultRetryableError
+		}
+		return nil
+	})
+}
+
+// withRetry runs op, and if it fails with an error p considers retryable,
+// waits according to p.backoff and runs it again, up to p.maxRetries times.
+// It must only wrap operations that have not yet handed anything to the
+// caller by the time they fail: conn.execute qualifies because it either
+// succeeds outright or fails before the native rows/statement handle it
+// would return escapes to ExecContext/QueryContext, so a failed attempt
+// never streams a partial result a retry could duplicate. ctx being done
+// aborts the wait between attempts.
+func withRetry(ctx context.Context, p *retryPolicy, op func() (C.libsql_rows_t, error)) (C.libsql_rows_t, error) {
+	rows, err := op()
+	for attempt := 1; err != nil && attempt <= p.maxRetries && p.isRetryable(err); attempt++ {
+		select {
+		case <-time.After(p.backoff(attempt)):
+		case <-ctx.Done():
+			return nil, err
+		}
+		rows, err = op()
+	}
+	return rows, err
+}
+
+// retryWithBackoff runs op, retrying per p's maxRetries/backoff/isRetryable
+// knobs the same way withRetry does, for callers whose op has no native
+// rows handle to worry about re-streaming -- Sync's retry is idempotent to
+// simply redo on a transient failure.
+func retryWithBackoff(ctx context.Context, p *retryPolicy, op func() error) error {
+	err := op()
+	for attempt := 1; err != nil && attempt <= p.maxRetries && p.isRetryable(err); attempt++ {
+		select {
+		case <-time.After(p.backoff(attempt)):
+		case <-ctx.Done():
+			return err
+		}
+		err = op()
+	}
+	return err
+}
+
+// retryConnect retries connectWithContext per p's policy when the initial
+// dial to a remote or embedded-replica primary fails with a retryable (e.g.
+// connection-lost) error, covering RetryPolicy's initial-connect leg
+// alongside Sync and ExecContext/QueryContext.
+func retryConnect(ctx context.Context, p *retryPolicy, nativeDbPtr C.libsql_database_t) (C.libsql_connection_t, error) {
+	ptr, err := connectWithContext(ctx, nativeDbPtr)
+	for attempt := 1; err != nil && attempt <= p.maxRetries && p.isRetryable(err); attempt++ {
+		select {
+		case <-time.After(p.backoff(attempt)):
+		case <-ctx.Done():
+			return nil, err
+		}
+		ptr, err = connectWithContext(ctx, nativeDbPtr)
+	}
+	return ptr, err
+}
+
+// applyRetryParams returns base overridden by p's _max_retries and
+// _retry_backoff DSN parameters (see parseConnParams), or base unchanged if
+// neither was set. It never mutates base.
+func (p *connParams) applyRetryParams(base *retryPolicy) *retryPolicy {
+	policy := *base
+	if p.maxRetries != nil {
+		policy.maxRetries = *p.maxRetries
+	}
+	if p.retryBackoff == "none" {
+		policy.backoff = func(int) time.Duration { return 0 }
+	}
+	return &policy
+}
+
+// retryingOp runs op through withRetry using c's retry policy, except once a
+// transaction is open on c (c.txDepth > 0). Mid-transaction, retrying a
+// failed statement would resend it after earlier statements in the same
+// transaction have already taken effect, risking duplicated or skipped
+// writes if the failure was not actually transient -- so once a transaction
+// has started, op runs exactly once and its result (success or failure) is
+// returned as-is, leaving the caller to retry the whole transaction instead
+// (see RunInTx).
+func (c *conn) retryingOp(ctx context.Context, op func() (C.libsql_rows_t, error)) (C.libsql_rows_t, error) {
+	if c.txDepth > 0 {
+		return op()
+	}
+	return withRetry(ctx, c.retryPolicy, op)
+}
+
+// RunInTx runs fn in a new transaction opened against this Connector,
+// automatically retrying the whole transaction from a fresh BeginTx if it
+// fails with an error this Connector's retry policy considers transient
+// (see WithRetryableErrors), up to WithMaxRetries times with WithRetryBackoff
+// between attempts. RunInTx calls Rollback whenever fn returns a non-nil
+// error and Commit otherwise; since every retry starts over from an empty
+// transaction, fn must be safe to run more than once -- it should have no
+// observable side effects beyond the database writes that the rolled-back
+// attempt already undid.
+func (c *Connector) RunInTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	c.dbOnce.Do(func() {
+		c.db = sql.OpenDB(c)
+	})
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = c.runTxOnce(ctx, fn)
+		if err == nil || attempt >= c.retryPolicy.maxRetries || !c.retryPolicy.isRetryable(err) {
+			return err
+		}
+		select {
+		case <-time.After(c.retryPolicy.backoff(attempt + 1)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (c *Connector) runTxOnce(ctx context.Context, fn func(*sql.Tx) error) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
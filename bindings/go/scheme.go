@@ -0,0 +1,75 @@
+//go:build cgo
+// +build cgo
+
+package libsql
+
+import (
+	sqldriver "database/sql/driver"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// UnsupportedSchemeError reports that a DSN's scheme is neither one of the
+// schemes driver.OpenConnector supports natively (file, :memory:, libsql,
+// http, https) nor one added with RegisterScheme.
+type UnsupportedSchemeError struct {
+	Scheme string
+}
+
+func (e *UnsupportedSchemeError) Error() string {
+	return fmt.Sprintf("libsql: unsupported URL scheme %q: must be libsql://, file:, :memory:, http://, https://, or a scheme added with RegisterScheme", e.Scheme)
+}
+
+// SchemeOpener opens a driver.Connector for a DSN using a scheme registered
+// with RegisterScheme. dsn is the full DSN, including its scheme.
+type SchemeOpener func(dsn string) (sqldriver.Connector, error)
+
+var (
+	schemesMu sync.Mutex
+	schemes   = map[string]SchemeOpener{}
+)
+
+// RegisterScheme adds a DSN scheme that sql.Open("libsql", dsn) and
+// driver.OpenConnector recognize, beyond the built-in file, :memory:,
+// libsql, http, and https schemes -- so a downstream package can plug in,
+// say, an s3:// restore-on-open scheme or a test-only in-process scheme
+// without patching this package, mirroring how database/sql itself lets
+// arbitrary drivers register under sql.Register. RegisterScheme is meant to
+// be called from an init function; like sql.Register, it panics on a nil
+// opener or a scheme that's already built-in or already registered, since
+// that is a programming error to catch at startup, not a runtime condition
+// for callers to handle.
+func RegisterScheme(scheme string, opener SchemeOpener) {
+	if opener == nil {
+		panic("libsql: RegisterScheme: opener must not be nil")
+	}
+	switch scheme {
+	case "file", "libsql", "http", "https":
+		panic(fmt.Sprintf("libsql: RegisterScheme: %q is a built-in scheme", scheme))
+	}
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+	if _, dup := schemes[scheme]; dup {
+		panic(fmt.Sprintf("libsql: RegisterScheme called twice for scheme %q", scheme))
+	}
+	schemes[scheme] = opener
+}
+
+// registeredSchemeOpener returns the SchemeOpener RegisterScheme registered
+// for dsn's scheme, if any. ":memory:" DSNs have no URL scheme to look up
+// and are never user-registerable, so they always report ok == false here.
+func registeredSchemeOpener(dsn string) (opener SchemeOpener, ok bool) {
+	if strings.HasPrefix(dsn, ":memory:") {
+		return nil, false
+	}
+	u, err := url.Parse(dsn)
+	if err != nil || u.Scheme == "" {
+		return nil, false
+	}
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+	opener, ok = schemes[u.Scheme]
+	return opener, ok
+}
@@ -0,0 +1,195 @@
+//go:build cgo
+// +build cgo
+
+package libsql
+
+/*
+#include <libsql.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// defaultStatementCacheSize is the per-connection prepared-statement cache
+// capacity used when WithStatementCacheSize is not given and the DSN does
+// not set _stmt_cache_size.
+const defaultStatementCacheSize = 100
+
+type statementCacheBypassKey struct{}
+
+// WithoutStatementCache returns a context that, when passed to a QueryContext
+// or ExecContext call, bypasses the connection's prepared-statement cache
+// for that one call: the statement is prepared and freed as usual instead
+// of being looked up in or returned to the cache. Useful for one-off
+// queries that would otherwise evict more frequently reused statements.
+func WithoutStatementCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, statementCacheBypassKey{}, true)
+}
+
+func bypassStmtCache(ctx context.Context) bool {
+	bypass, _ := ctx.Value(statementCacheBypassKey{}).(bool)
+	return bypass
+}
+
+// ddlPattern matches statements that change the schema, the trigger for
+// invalidating every cached prepared statement on this connection: a
+// prepared statement's column/param layout can silently go stale once the
+// table or index it refers to is altered.
+var ddlPattern = regexp.MustCompile(`(?i)^\s*(create|drop|alter)\s`)
+
+func looksLikeDDL(query string) bool {
+	return ddlPattern.MatchString(query)
+}
+
+// stmtCacheEntry is one native prepared statement held in a stmtCache,
+// named by the SQL text it was prepared from.
+type stmtCacheEntry struct {
+	query string
+	stmt  C.libsql_stmt_t
+}
+
+// stmtCache is an LRU cache of native prepared statements, keyed by SQL
+// text, scoped to a single *conn. execute checks it out a statement on
+// entry and checks it back in (or drops it) once done, so a statement is
+// never in the cache and in use at the same time.
+type stmtCache struct {
+	mu        sync.Mutex
+	capacity  int
+	entries   map[string]*list.Element
+	order     *list.List
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// newStmtCache returns a stmtCache with the given capacity, or nil if
+// capacity is 0, which conn treats as "caching disabled".
+func newStmtCache(capacity int) *stmtCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &stmtCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get removes and returns the cached statement for query, resetting it so
+// it is ready to be re-bound, if present. A statement is absent from the
+// cache while checked out this way; put returns it (or a different
+// statement prepared fresh for the same query) once execute is done.
+func (sc *stmtCache) get(query string) (C.libsql_stmt_t, bool) {
+	sc.mu.Lock()
+	el, ok := sc.entries[query]
+	if !ok {
+		sc.misses++
+		sc.mu.Unlock()
+		return nil, false
+	}
+	entry := sc.order.Remove(el).(*stmtCacheEntry)
+	delete(sc.entries, query)
+	sc.hits++
+	sc.mu.Unlock()
+
+	var errMsg *C.char
+	if statusCode := C.libsql_reset_stmt(entry.stmt, &errMsg); statusCode != 0 {
+		C.libsql_free_stmt(entry.stmt)
+		return nil, false
+	}
+	return entry.stmt, true
+}
+
+// put checks stmt back into the cache under query, evicting the
+// least-recently-used entry if the cache is already at capacity.
+func (sc *stmtCache) put(query string, stmt C.libsql_stmt_t) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.order.Len() >= sc.capacity {
+		oldest := sc.order.Back()
+		if oldest != nil {
+			evicted := sc.order.Remove(oldest).(*stmtCacheEntry)
+			delete(sc.entries, evicted.query)
+			C.libsql_free_stmt(evicted.stmt)
+			sc.evictions++
+		}
+	}
+	sc.entries[query] = sc.order.PushFront(&stmtCacheEntry{query: query, stmt: stmt})
+}
+
+// invalidateAll frees every statement currently checked into the cache and
+// empties it. Called on Close and whenever a DDL statement runs, since a
+// schema change can invalidate the layout any cached statement assumed.
+// Statements currently checked out by an in-flight execute are freed by
+// that call's own cleanup, not by invalidateAll.
+func (sc *stmtCache) invalidateAll() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, el := range sc.entries {
+		entry := el.Value.(*stmtCacheEntry)
+		C.libsql_free_stmt(entry.stmt)
+	}
+	sc.entries = make(map[string]*list.Element)
+	sc.order.Init()
+}
+
+// CacheStats reports the hits, misses, evictions, and current size of a
+// connection's prepared-statement cache; see Stats.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Size      int
+}
+
+func (sc *stmtCache) snapshot() CacheStats {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return CacheStats{
+		Hits:      sc.hits,
+		Misses:    sc.misses,
+		Evictions: sc.evictions,
+		Size:      sc.order.Len(),
+	}
+}
+
+// Stats reports the prepared-statement cache stats for one physical
+// connection checked out of db's pool, so callers can tune
+// WithStatementCacheSize or the DSN's _stmt_cache_size against their own
+// workload. db must come from this package's driver; since *sql.DB pools
+// many connections, each with its own cache, calling this on a db with more
+// than one open connection reports whichever connection the pool happens
+// to hand back.
+func Stats(db *sql.DB) (CacheStats, error) {
+	ctx := context.Background()
+	sqlConn, err := db.Conn(ctx)
+	if err != nil {
+		return CacheStats{}, err
+	}
+	defer sqlConn.Close()
+
+	var stats CacheStats
+	err = sqlConn.Raw(func(driverConn any) error {
+		c, ok := driverConn.(*conn)
+		if !ok {
+			return fmt.Errorf("libsql: Stats's db must come from this package's driver")
+		}
+		if c.stmtCache == nil {
+			return nil
+		}
+		stats = c.stmtCache.snapshot()
+		return nil
+	})
+	if err != nil {
+		return CacheStats{}, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,141 @@
+//go:build cgo
+// +build cgo
+
+package libsql
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// syncManager owns the background goroutine that periodically syncs an
+// embedded replica Connector against its primary on behalf of
+// openEmbeddedReplicaConnector. It uses a single timer rather than spawning
+// a new goroutine per tick, coalesces concurrent sync requests (see
+// syncNow) so a slow primary never causes more than one sync to be in
+// flight at once, and backs off exponentially (capped, with jitter) after
+// consecutive failures so a primary that is down doesn't get hammered once
+// per syncInterval forever.
+type syncManager struct {
+	c        *Connector
+	interval time.Duration
+
+	mu                  sync.Mutex
+	syncing             bool
+	waiters             []chan error
+	consecutiveFailures int
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+	done      chan struct{}
+}
+
+func newSyncManager(c *Connector, interval time.Duration) *syncManager {
+	m := &syncManager{
+		c:        c,
+		interval: interval,
+		closeCh:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+func (m *syncManager) run() {
+	defer close(m.done)
+	timer := time.NewTimer(m.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-m.closeCh:
+			return
+		case <-timer.C:
+			// A failure here is already reported through the structured
+			// path: syncOnce records it in c.stats.ErrorCount (see
+			// Connector.Stats) and, if WithSyncHook was used, delivers a
+			// SyncEvent with Phase == SyncPhaseError. There is no
+			// additional fallback -- a background sync loop must not
+			// print to stdout on behalf of a caller who didn't ask for it.
+			m.syncNow(context.Background())
+			timer.Reset(m.nextDelay())
+		}
+	}
+}
+
+// nextDelay is m.interval after a successful sync, or an exponentially
+// longer, jittered backoff (see syncBackoff) after one or more consecutive
+// failures.
+func (m *syncManager) nextDelay() time.Duration {
+	m.mu.Lock()
+	failures := m.consecutiveFailures
+	m.mu.Unlock()
+	if failures == 0 {
+		return m.interval
+	}
+	return syncBackoff(failures)
+}
+
+// syncBackoff computes how long the periodic sync goroutine waits before
+// retrying after consecutiveFailures in a row, exponential with jitter and
+// capped, mirroring defaultRetryBackoff's shape.
+func syncBackoff(consecutiveFailures int) time.Duration {
+	const (
+		base    = 1 * time.Second
+		maxWait = 5 * time.Minute
+	)
+	d := base << consecutiveFailures
+	if d <= 0 || d > maxWait {
+		d = maxWait
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// syncNow runs a sync against the primary, or -- if one is already in
+// flight -- waits for that sync to finish and returns its result instead of
+// starting a redundant second one. ctx only bounds the wait for an
+// already-in-flight sync; a sync started by this call runs to completion
+// regardless of ctx.
+func (m *syncManager) syncNow(ctx context.Context) error {
+	m.mu.Lock()
+	if m.syncing {
+		waitCh := make(chan error, 1)
+		m.waiters = append(m.waiters, waitCh)
+		m.mu.Unlock()
+		select {
+		case err := <-waitCh:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	m.syncing = true
+	m.mu.Unlock()
+
+	err := m.c.Sync()
+
+	m.mu.Lock()
+	m.syncing = false
+	waiters := m.waiters
+	m.waiters = nil
+	if err != nil {
+		m.consecutiveFailures++
+	} else {
+		m.consecutiveFailures = 0
+	}
+	m.mu.Unlock()
+
+	for _, w := range waiters {
+		w <- err
+	}
+	return err
+}
+
+// close stops the periodic sync goroutine and waits for it to exit, which
+// includes waiting for a sync that goroutine has in flight. It does not wait
+// for a sync started by another caller, such as TriggerSync.
+func (m *syncManager) close() {
+	m.closeOnce.Do(func() { close(m.closeCh) })
+	<-m.done
+}
@@ -0,0 +1,113 @@
+//go:build cgo
+// +build cgo
+
+package libsql
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimeFormat selects how conn.execute binds a time.Time argument as a SQL
+// parameter; see WithTimeFormat.
+type TimeFormat int
+
+const (
+	// TimeFormatISO8601 binds time.Time as a "YYYY-MM-DD HH:MM:SS.SSSSSSSSS+HH:MM"
+	// string (see sqliteTimeLayout), the layout mattn/go-sqlite3 uses and
+	// that SQLite's own date/time functions parse natively. This is the
+	// default.
+	TimeFormatISO8601 TimeFormat = iota
+	// TimeFormatUnix binds time.Time as an INTEGER of Unix seconds,
+	// matching modernc.org/sqlite's default.
+	TimeFormatUnix
+)
+
+// sqliteTimeLayout is the layout conn.execute formats a time.Time with
+// under TimeFormatISO8601.
+const sqliteTimeLayout = "2006-01-02 15:04:05.999999999-07:00"
+
+// formatTime renders t as a SQL parameter value under format: a string for
+// TimeFormatISO8601, or a count of Unix seconds for TimeFormatUnix.
+func formatTime(t time.Time, format TimeFormat) interface{} {
+	if format == TimeFormatUnix {
+		return t.Unix()
+	}
+	return t.Format(sqliteTimeLayout)
+}
+
+// sqliteTimeDecodeLayouts are tried in order by parseSQLiteTime. They cover
+// the space- and "T"-separated forms SQLite itself, mattn/go-sqlite3, and
+// sqliteTimeLayout all produce, so a column written by any of them round-
+// trips back into a time.Time.
+var sqliteTimeDecodeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// looksLikeTimeDecltype reports whether a column's declared SQL type (as
+// reported by libsql_column_decltype) signals that its TEXT values should
+// be decoded as time.Time: DATE, DATETIME, or TIMESTAMP, the same
+// convention mattn/go-sqlite3 and modernc.org/sqlite use, regardless of
+// case or a length/precision suffix such as DATETIME(3).
+func looksLikeTimeDecltype(decltype string) bool {
+	name, _, _ := strings.Cut(decltype, "(")
+	switch strings.ToUpper(strings.TrimSpace(name)) {
+	case "DATE", "DATETIME", "TIMESTAMP":
+		return true
+	}
+	return false
+}
+
+// parseSQLiteTime parses s, a TEXT value from a DATE/DATETIME/TIMESTAMP
+// column, trying sqliteTimeDecodeLayouts in turn, defaulting any layout
+// without its own offset to loc.
+func parseSQLiteTime(s string, loc *time.Location) (time.Time, error) {
+	for _, layout := range sqliteTimeDecodeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("value %q does not match a known date/time layout", s)
+}
+
+// WithTimeFormat selects how a time.Time argument is stored when bound as a
+// SQL parameter on connections from this Connector: TimeFormatISO8601 (the
+// default) or TimeFormatUnix.
+func WithTimeFormat(format TimeFormat) Option {
+	return option(func(o *config) error {
+		if o.timeFormat != nil {
+			return fmt.Errorf("time format already set")
+		}
+		switch format {
+		case TimeFormatISO8601, TimeFormatUnix:
+		default:
+			return fmt.Errorf("unknown time format %d", format)
+		}
+		o.timeFormat = &format
+		return nil
+	})
+}
+
+// WithTimeLocation sets the time.Location a DATE/DATETIME/TIMESTAMP column
+// is decoded into. The default is time.UTC.
+func WithTimeLocation(loc *time.Location) Option {
+	return option(func(o *config) error {
+		if o.timeLocation != nil {
+			return fmt.Errorf("time location already set")
+		}
+		if loc == nil {
+			return fmt.Errorf("time location must not be nil")
+		}
+		o.timeLocation = loc
+		return nil
+	})
+}
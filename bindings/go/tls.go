@@ -0,0 +1,133 @@
+//go:build cgo
+// +build cgo
+
+package libsql
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// resolveTLSConfig merges sslMode's semantics into tlsConfig, returning a
+// config ready to be used for both the Go-side preflight dial and (via PEM
+// re-encoding) the native sync client. tlsConfig may be nil.
+func resolveTLSConfig(tlsConfig *tls.Config, sslMode string) *tls.Config {
+	if sslMode == "disable" {
+		return nil
+	}
+	var cfg *tls.Config
+	if tlsConfig != nil {
+		cfg = tlsConfig.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	switch sslMode {
+	case "", "verify-full":
+		// The zero-value behavior of crypto/tls already verifies both the
+		// chain and the hostname.
+	case "require":
+		cfg.InsecureSkipVerify = true
+	case "verify-ca":
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = verifyChainIgnoringHostname(cfg)
+	}
+	return cfg
+}
+
+// verifyChainIgnoringHostname builds a VerifyPeerCertificate callback that
+// validates the certificate chain against cfg.RootCAs (or the system trust
+// store if nil) without checking that the certificate matches the server
+// name being dialed.
+func verifyChainIgnoringHostname(cfg *tls.Config) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("libsql: no certificate presented by primary")
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("libsql: parsing primary certificate: %w", err)
+		}
+		intermediates := x509.NewCertPool()
+		for _, raw := range rawCerts[1:] {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("libsql: parsing intermediate certificate: %w", err)
+			}
+			intermediates.AddCert(cert)
+		}
+		_, err = leaf.Verify(x509.VerifyOptions{
+			Roots:         cfg.RootCAs,
+			Intermediates: intermediates,
+		})
+		return err
+	}
+}
+
+// preflightTLS dials primaryUrl's host and performs a TLS handshake so that
+// a misconfigured CA or client certificate surfaces as an error from
+// NewEmbeddedReplicaConnector itself rather than silently at the first Sync.
+// It is a no-op for non-TLS schemes or when tlsConfig is nil (sslMode
+// "disable").
+func preflightTLS(primaryUrl string, tlsConfig *tls.Config) error {
+	if tlsConfig == nil {
+		return nil
+	}
+	u, err := url.Parse(primaryUrl)
+	if err != nil {
+		return fmt.Errorf("libsql: parsing primary URL for TLS preflight: %w", err)
+	}
+	switch u.Scheme {
+	case "https", "libsql":
+	default:
+		return nil
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	}
+	conn, err := tls.Dial("tcp", host, tlsConfig)
+	if err != nil {
+		return fmt.Errorf("libsql: TLS preflight against %s failed: %w", host, err)
+	}
+	return conn.Close()
+}
+
+// clientCertificateToPEM re-encodes the first client certificate configured
+// on tlsConfig (if any) into PEM so it can cross the cgo boundary, the same
+// way authToken and encryptionKey already do as C strings.
+func clientCertificateToPEM(tlsConfig *tls.Config) (certPEM, keyPEM string, err error) {
+	if tlsConfig == nil || len(tlsConfig.Certificates) == 0 {
+		return "", "", nil
+	}
+	cert := tlsConfig.Certificates[0]
+
+	var certBuf bytes.Buffer
+	for _, der := range cert.Certificate {
+		if err := pem.Encode(&certBuf, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return "", "", err
+		}
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return "", "", fmt.Errorf("marshaling private key: %w", err)
+	}
+	var keyBuf bytes.Buffer
+	if err := pem.Encode(&keyBuf, &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}); err != nil {
+		return "", "", err
+	}
+
+	return certBuf.String(), keyBuf.String(), nil
+}
+
+func sslModeOrDefault(sslMode string) string {
+	if sslMode == "" {
+		return "verify-full"
+	}
+	return sslMode
+}